@@ -3,163 +3,811 @@ package exprel
 import (
 	"bytes"
 	"math"
-	"math/rand"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
-var baseSource = SourceMap{
+var baseFuncs = []*FuncDef{
 	// Etc.
-	"CHOOSE": func(c *Call) (interface{}, error) {
-		number := c.Number(0)
-		rest := c.Values[1:]
-		index := int(number)
-		if index < 0 || index >= len(rest) {
-			panic(&RuntimeError{Message: "CHOOSE index out of range"})
-		}
-		return rest[index], nil
-	},
-	"TYPE": func(c *Call) (interface{}, error) {
-		if len(c.Values) < 1 {
-			panic(&RuntimeError{Message: "TYPE requires one argument"})
-		}
-		switch c.Values[0].(type) {
-		case float64:
-			return float64(1), nil
-		case string:
-			return float64(2), nil
-		case bool:
-			return float64(4), nil
-		default:
-			panic("never reached")
-		}
+	{
+		Name: "CHOOSE",
+		Params: []Param{
+			{Name: "index", Type: TypeNumber},
+			{Type: TypeAny, Variadic: true},
+		},
+		Returns:     TypeAny,
+		Description: "Returns the index item of the remaining arguments.",
+		Examples:    []string{`=CHOOSE(1; "a"; "b"; "c")`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			number := c.Number(0)
+			rest := c.Values[1:]
+			index := int(number)
+			if index < 0 || index >= len(rest) {
+				panic(&RuntimeError{Message: "CHOOSE index out of range", Kind: ErrInvalidArgument})
+			}
+			return rest[index], nil
+		},
+	},
+	{
+		Name: "TYPE",
+		Params: []Param{
+			{Name: "a", Type: TypeAny},
+		},
+		Returns:     TypeNumber,
+		Description: "Identifies the type of a: 1 for numbers, 2 for strings, 4 for booleans, 64 for arrays, 128 for functions and 256 for records.",
+		Examples:    []string{`=TYPE("a")`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			switch c.Values[0].(type) {
+			case float64:
+				return float64(1), nil
+			case string:
+				return float64(2), nil
+			case bool:
+				return float64(4), nil
+			case Array:
+				return float64(64), nil
+			case Func:
+				return float64(128), nil
+			case Record:
+				return float64(256), nil
+			default:
+				panic("never reached")
+			}
+		},
 	},
 
 	// Math
-	"ABS": func(c *Call) (interface{}, error) {
-		number := c.Number(0)
-		return math.Abs(number), nil
-	},
-	"EXP": func(c *Call) (interface{}, error) {
-		number := c.Number(0)
-		return math.Exp(number), nil
-	},
-	"LN": func(c *Call) (interface{}, error) {
-		number := c.Number(0)
-		return math.Log(number), nil
-	},
-	"LOG10": func(c *Call) (interface{}, error) {
-		number := c.Number(0)
-		return math.Log10(number), nil
-	},
-	"PI": func(c *Call) (interface{}, error) {
-		return float64(math.Pi), nil
-	},
-	"RAND": func(c *Call) (interface{}, error) {
-		return rand.Float64(), nil
-	},
-	"SIGN": func(c *Call) (interface{}, error) {
-		number := c.Number(0)
-		if number < 0 {
-			return float64(-1), nil
-		}
-		if number > 0 {
-			return float64(1), nil
-		}
-		return float64(0), nil
+	{
+		Name: "ABS",
+		Params: []Param{
+			{Name: "a", Type: TypeNumber},
+		},
+		Returns:     TypeNumber,
+		Description: "Returns the absolute value of a.",
+		Examples:    []string{`=ABS(-2)`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			number := c.Number(0)
+			return math.Abs(number), nil
+		},
+	},
+	{
+		Name: "EXP",
+		Params: []Param{
+			{Name: "a", Type: TypeNumber},
+		},
+		Returns:     TypeNumber,
+		Description: "Returns e^a.",
+		Examples:    []string{`=EXP(1)`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			number := c.Number(0)
+			return math.Exp(number), nil
+		},
+	},
+	{
+		Name: "LN",
+		Params: []Param{
+			{Name: "a", Type: TypeNumber},
+		},
+		Returns:     TypeNumber,
+		Description: "Returns the natural logarithm of a.",
+		Examples:    []string{`=LN(EXP(2))`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			number := c.Number(0)
+			return math.Log(number), nil
+		},
+	},
+	{
+		Name: "LOG10",
+		Params: []Param{
+			{Name: "a", Type: TypeNumber},
+		},
+		Returns:     TypeNumber,
+		Description: "Returns the base-10 logarithm of a.",
+		Examples:    []string{`=LOG10(1000)`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			number := c.Number(0)
+			return math.Log10(number), nil
+		},
+	},
+	{
+		Name:        "PI",
+		Returns:     TypeNumber,
+		Description: "Returns π.",
+		Examples:    []string{`=PI() * 2`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			return float64(math.Pi), nil
+		},
+	},
+	{
+		Name:        "RAND",
+		Returns:     TypeNumber,
+		Description: "Returns a random number in the range [0, 1).",
+		Examples:    []string{`=RAND() * 6`},
+		Volatile:    true,
+		Func: func(c *Call) (interface{}, error) {
+			return c.Random(), nil
+		},
+	},
+	{
+		Name: "SIGN",
+		Params: []Param{
+			{Name: "a", Type: TypeNumber},
+		},
+		Returns:     TypeNumber,
+		Description: "Returns the sign of a.",
+		Examples:    []string{`=SIGN(-5)`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			number := c.Number(0)
+			if number < 0 {
+				return float64(-1), nil
+			}
+			if number > 0 {
+				return float64(1), nil
+			}
+			return float64(0), nil
+		},
 	},
 
 	// Strings
-	"CHAR": func(c *Call) (interface{}, error) {
-		var r []rune
-		for _, v := range c.Values {
-			code, ok := v.(float64)
-			if !ok {
-				panic(&RuntimeError{Message: "CHAR argument must be number"})
+	{
+		Name: "CHAR",
+		Params: []Param{
+			{Type: TypeNumber, Variadic: true},
+		},
+		Returns:     TypeString,
+		Description: "Returns a string whose code points are given as arguments.",
+		Examples:    []string{`=CHAR(72; 105)`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			var r []rune
+			length := 0
+			for _, v := range c.Values {
+				code := rune(v.(float64))
+				r = append(r, code)
+				if n := utf8.RuneLen(code); n > 0 {
+					length += n
+				} else {
+					length += utf8.RuneLen(utf8.RuneError)
+				}
+			}
+			checkStringLength(c.Context(), length)
+			return string(r), nil
+		},
+	},
+	{
+		Name: "JOIN",
+		Params: []Param{
+			{Name: "sep", Type: TypeString},
+			{Type: TypeString, Variadic: true},
+		},
+		Returns:     TypeString,
+		Description: "Returns the trailing string arguments concatenated together with sep.",
+		Examples:    []string{`=JOIN(", "; "a"; "b")`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			sep := c.String(0)
+			length := 0
+			for i, v := range c.Values[1:] {
+				if i > 0 {
+					length += len(sep)
+				}
+				length += len(v.(string))
+			}
+			checkStringLength(c.Context(), length)
+			var buff bytes.Buffer
+			for i, v := range c.Values[1:] {
+				if i > 0 {
+					buff.WriteString(sep)
+				}
+				buff.WriteString(v.(string))
+			}
+			return buff.String(), nil
+		},
+	},
+	{
+		Name: "LEFT",
+		Params: []Param{
+			{Name: "a", Type: TypeString},
+			{Name: "count", Type: TypeNumber, Optional: true, Default: float64(1)},
+		},
+		Returns:     TypeString,
+		Description: "Returns the count left-most characters of a.",
+		Examples:    []string{`=LEFT("abc"; 2)`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			str := c.String(0)
+			count := int(c.Number(1))
+			if count > len(str) {
+				return str, nil
+			}
+			return str[:count], nil
+		},
+	},
+	{
+		Name: "LEN",
+		Params: []Param{
+			{Name: "a", Type: TypeString},
+		},
+		Returns:     TypeNumber,
+		Description: "Returns the length of a.",
+		Examples:    []string{`=LEN("abc")`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			str := c.String(0)
+			return float64(len(str)), nil
+		},
+	},
+	{
+		Name: "LOWER",
+		Params: []Param{
+			{Name: "a", Type: TypeString},
+		},
+		Returns:     TypeString,
+		Description: "Returns a with all uppercase characters transformed to lowercase.",
+		Examples:    []string{`=LOWER("ABC")`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			str := c.String(0)
+			return strings.ToLower(str), nil
+		},
+	},
+	{
+		Name: "MID",
+		Params: []Param{
+			{Name: "a", Type: TypeString},
+			{Name: "start", Type: TypeNumber},
+			{Name: "length", Type: TypeNumber, Optional: true, Default: float64(1)},
+		},
+		Returns:     TypeString,
+		Description: "Returns length characters of a, starting from start.",
+		Examples:    []string{`=MID("abcde"; 2; 3)`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			str := c.String(0)
+			start := int(c.Number(1)) - 1
+			length := int(c.Number(2))
+			if len(str) <= start || start < 0 {
+				return "", nil
+			}
+			if len(str) <= start+length {
+				return str[start:], nil
 			}
-			r = append(r, rune(code))
-		}
-		return string(r), nil
+			return str[start : start+length], nil
+		},
 	},
-	"JOIN": func(c *Call) (interface{}, error) {
-		sep := c.String(0)
-		var buff bytes.Buffer
-		for i, v := range c.Values[1:] {
-			str, ok := v.(string)
+	{
+		Name: "REPT",
+		Params: []Param{
+			{Name: "a", Type: TypeString},
+			{Name: "count", Type: TypeNumber},
+		},
+		Returns:     TypeString,
+		Description: "Returns the string a, repeated count times.",
+		Examples:    []string{`=REPT("ab"; 3)`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			str := c.String(0)
+			count := c.Number(1)
+			if count < 0 {
+				panic(&RuntimeError{Message: "REPT argument must be positive", Kind: ErrInvalidArgument})
+			}
+			// the length is computed as a float64, which cannot overflow
+			length := float64(len(str)) * math.Floor(count)
+			if !(count < maxIntFloat) || !(length < maxIntFloat) {
+				panic(&RuntimeError{Message: "REPT result is too long", Kind: ErrLimitExceeded})
+			}
+			checkStringLength(c.Context(), int(length))
+			return strings.Repeat(str, int(count)), nil
+		},
+	},
+	{
+		Name: "RIGHT",
+		Params: []Param{
+			{Name: "a", Type: TypeString},
+			{Name: "count", Type: TypeNumber, Optional: true, Default: float64(1)},
+		},
+		Returns:     TypeString,
+		Description: "Returns the count right-most characters of a.",
+		Examples:    []string{`=RIGHT("abc"; 2)`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			str := c.String(0)
+			count := int(c.Number(1))
+			if count > len(str) {
+				return str, nil
+			}
+			return str[len(str)-count:], nil
+		},
+	},
+	{
+		Name: "SEARCH",
+		Params: []Param{
+			{Name: "needle", Type: TypeString},
+			{Name: "haystack", Type: TypeString},
+			{Name: "start", Type: TypeNumber, Optional: true, Default: float64(1)},
+		},
+		Returns:     TypeNumber,
+		Description: "Returns the position of needle in haystack, starting from start. -1 is returned if needle was not found.",
+		Examples:    []string{`=SEARCH("c"; "abcabc"; 4)`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			needle := c.String(0)
+			haystack := c.String(1)
+			start := int(c.Number(2)) - 1
+			if len(haystack) <= start || start < 0 {
+				return float64(-1), nil
+			}
+			ret := strings.Index(haystack[start:], needle)
+			if ret == -1 {
+				return float64(-1), nil
+			}
+			return float64(ret + start + 1), nil
+		},
+	},
+	{
+		Name: "TRIM",
+		Params: []Param{
+			{Name: "a", Type: TypeString},
+		},
+		Returns:     TypeString,
+		Description: "Returns a with whitespace removed from the beginning and end.",
+		Examples:    []string{`=TRIM("  abc ")`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			str := c.String(0)
+			return strings.TrimSpace(str), nil
+		},
+	},
+	{
+		Name: "UPPER",
+		Params: []Param{
+			{Name: "a", Type: TypeString},
+		},
+		Returns:     TypeString,
+		Description: "Returns a with all lowercase characters transformed to uppercase.",
+		Examples:    []string{`=UPPER("abc")`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			str := c.String(0)
+			return strings.ToUpper(str), nil
+		},
+	},
+
+	// Dates
+	{
+		Name:        "NOW",
+		Returns:     TypeNumber,
+		Description: "Returns the current date and time as a serial date number.",
+		Examples:    []string{`=TEXT(NOW(); "yyyy-mm-dd hh:mm")`},
+		Volatile:    true,
+		Func: func(c *Call) (interface{}, error) {
+			return timeToSerial(c.Now()), nil
+		},
+	},
+	{
+		Name:        "TODAY",
+		Returns:     TypeNumber,
+		Description: "Returns the current date as a serial date number.",
+		Examples:    []string{`=TEXT(TODAY(); "yyyy-mm-dd")`},
+		Volatile:    true,
+		Func: func(c *Call) (interface{}, error) {
+			return math.Floor(timeToSerial(c.Now())), nil
+		},
+	},
+
+	// Conversion
+	{
+		Name: "DOLLAR",
+		Params: []Param{
+			{Name: "a", Type: TypeNumber},
+			{Name: "decimals", Type: TypeNumber, Optional: true, Default: float64(2)},
+		},
+		Returns:     TypeString,
+		Description: "Returns a formatted as currency, rounded to decimals places.",
+		Examples:    []string{`=DOLLAR(-1234.567)`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			number := c.Number(0)
+			decimals := decimalsArg(c, 1)
+			str := formatFixed(number, decimals, true)
+			if strings.HasPrefix(str, "-") {
+				return "($" + str[1:] + ")", nil
+			}
+			return "$" + str, nil
+		},
+	},
+	{
+		Name: "FIXED",
+		Params: []Param{
+			{Name: "a", Type: TypeNumber},
+			{Name: "decimals", Type: TypeNumber, Optional: true, Default: float64(2)},
+			{Name: "noCommas", Type: TypeBoolean, Optional: true, Default: false},
+		},
+		Returns:     TypeString,
+		Description: "Returns a rounded to decimals places, with thousands separated by commas unless noCommas is true.",
+		Examples:    []string{`=FIXED(1234.567; 1)`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			number := c.Number(0)
+			decimals := decimalsArg(c, 1)
+			noCommas := c.Boolean(2)
+			return formatFixed(number, decimals, !noCommas), nil
+		},
+	},
+	{
+		Name: "N",
+		Params: []Param{
+			{Name: "a", Type: TypeAny},
+		},
+		Returns:     TypeNumber,
+		Description: "Returns a if it is a number, 1 or 0 if it is a boolean, and 0 otherwise.",
+		Examples:    []string{`=N(TRUE())`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			switch v := c.Values[0].(type) {
+			case float64:
+				return v, nil
+			case bool:
+				if v {
+					return float64(1), nil
+				}
+				return float64(0), nil
+			default:
+				return float64(0), nil
+			}
+		},
+	},
+	{
+		Name: "NUMBERVALUE",
+		Params: []Param{
+			{Name: "a", Type: TypeString},
+			{Name: "decimal", Type: TypeString, Optional: true, Default: "."},
+			{Name: "group", Type: TypeString, Optional: true, Default: ","},
+		},
+		Returns:     TypeNumber,
+		Description: "Returns the number represented by a, using the given decimal and group separators. Trailing percent signs divide the number by 100.",
+		Examples:    []string{`=NUMBERVALUE("1.234,5"; ","; ".")`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			str := c.String(0)
+			decimal := c.String(1)
+			group := c.String(2)
+			if utf8.RuneCountInString(decimal) != 1 {
+				panic(&RuntimeError{Message: "NUMBERVALUE decimal separator must be a single character", Kind: ErrInvalidArgument})
+			}
+			if group == decimal {
+				panic(&RuntimeError{Message: "NUMBERVALUE separators must differ", Kind: ErrInvalidArgument})
+			}
+			number, ok := parseNumber(str, decimal, group)
 			if !ok {
-				panic(&RuntimeError{Message: "JOIN arguments must be string"})
-			}
-			if i > 0 {
-				buff.WriteString(sep)
-			}
-			buff.WriteString(str)
-		}
-		return buff.String(), nil
-	},
-	"LEFT": func(c *Call) (interface{}, error) {
-		str := c.String(0)
-		count := int(c.OptNumber(1, 1))
-		if count > len(str) {
-			return str, nil
-		}
-		return str[:count], nil
-	},
-	"LEN": func(c *Call) (interface{}, error) {
-		str := c.String(0)
-		return float64(len(str)), nil
-	},
-	"LOWER": func(c *Call) (interface{}, error) {
-		str := c.String(0)
-		return strings.ToLower(str), nil
-	},
-	"MID": func(c *Call) (interface{}, error) {
-		str := c.String(0)
-		start := int(c.Number(1)) - 1
-		length := int(c.OptNumber(2, 1))
-		if len(str) <= start || start < 0 {
+				panic(&RuntimeError{Message: "NUMBERVALUE cannot convert '" + str + "' to number", Kind: ErrInvalidArgument})
+			}
+			return number, nil
+		},
+	},
+	{
+		Name: "T",
+		Params: []Param{
+			{Name: "a", Type: TypeAny},
+		},
+		Returns:     TypeString,
+		Description: "Returns a if it is a string, and \"\" otherwise.",
+		Examples:    []string{`=T(1)`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			if str, ok := c.Values[0].(string); ok {
+				return str, nil
+			}
 			return "", nil
-		}
-		if len(str) <= start+length {
-			return str[start:], nil
-		}
-		return str[start : start+length], nil
-	},
-	"REPT": func(c *Call) (interface{}, error) {
-		str := c.String(0)
-		count := c.Number(1)
-		if count < 0 {
-			panic(&RuntimeError{Message: "REPT argument must be positive"})
-		}
-		return strings.Repeat(str, int(count)), nil
-	},
-	"RIGHT": func(c *Call) (interface{}, error) {
-		str := c.String(0)
-		count := int(c.OptNumber(1, 1))
-		if count > len(str) {
-			return str, nil
-		}
-		return str[len(str)-count:], nil
-	},
-	"SEARCH": func(c *Call) (interface{}, error) {
-		needle := c.String(0)
-		haystack := c.String(1)
-		start := int(c.OptNumber(2, 1)) - 1
-		if len(haystack) <= start || start < 0 {
-			return float64(-1), nil
-		}
-		ret := strings.Index(haystack[start:], needle)
-		if ret == -1 {
-			return float64(-1), nil
-		}
-		return float64(ret + start + 1), nil
-	},
-	"TRIM": func(c *Call) (interface{}, error) {
-		str := c.String(0)
-		return strings.TrimSpace(str), nil
-	},
-	"UPPER": func(c *Call) (interface{}, error) {
-		str := c.String(0)
-		return strings.ToUpper(str), nil
+		},
+	},
+	{
+		Name: "TEXT",
+		Params: []Param{
+			{Name: "a", Type: TypeAny},
+			{Name: "format", Type: TypeString},
+		},
+		Returns:     TypeString,
+		Description: "Returns a formatted using a spreadsheet format code. Number codes (0, #, ?, \".\", \",\", %), date codes (y, m, d, h, s, AM/PM) applied to serial dates, elapsed time codes ([h], [m], [s]), quoted literals and up to four ';' separated sections are supported.",
+		Examples:    []string{`=TEXT(0.285; "0.0%")`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			format := c.String(1)
+			text, ok := formatText(c.Values[0], format)
+			if !ok {
+				panic(&RuntimeError{Message: "TEXT date out of range", Kind: ErrInvalidArgument})
+			}
+			return text, nil
+		},
+	},
+	{
+		Name: "VALUE",
+		Params: []Param{
+			{Name: "a", Type: TypeAny},
+		},
+		Returns:     TypeNumber,
+		Description: "Returns the number represented by the string a. Numbers are returned unchanged.",
+		Examples:    []string{`=VALUE("1,234.5")`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			if number, ok := c.Values[0].(float64); ok {
+				return number, nil
+			}
+			str := c.String(0)
+			number, ok := parseNumber(str, ".", ",")
+			if !ok {
+				panic(&RuntimeError{Message: "VALUE cannot convert '" + str + "' to number", Kind: ErrInvalidArgument})
+			}
+			return number, nil
+		},
+	},
+
+	// Arrays
+	{
+		Name: "BYCOL",
+		Params: []Param{
+			{Name: "a", Type: TypeArray},
+			{Name: "fn", Type: TypeFunction},
+		},
+		Returns:     TypeArray,
+		Description: "Returns an array with one row, containing the results of calling fn with each column of a.",
+		Examples:    []string{`=BYCOL({1; 2 | 3; 4}; LAMBDA(col; INDEX(col; 1) + INDEX(col; 2)))`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			a := c.Values[0].(Array)
+			fn := c.Values[1].(Func)
+			row := make([]interface{}, a.Columns())
+			for j := range row {
+				column := make(Array, a.Rows())
+				for i := range column {
+					column[i] = []interface{}{a[i][j]}
+				}
+				row[j] = scalar(c, c.invoke(fn, column))
+			}
+			return Array{row}, nil
+		},
+	},
+	{
+		Name: "BYROW",
+		Params: []Param{
+			{Name: "a", Type: TypeArray},
+			{Name: "fn", Type: TypeFunction},
+		},
+		Returns:     TypeArray,
+		Description: "Returns an array with one column, containing the results of calling fn with each row of a.",
+		Examples:    []string{`=BYROW({1; 2 | 3; 4}; LAMBDA(row; INDEX(row; 1; 1) * INDEX(row; 1; 2)))`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			a := c.Values[0].(Array)
+			fn := c.Values[1].(Func)
+			result := make(Array, a.Rows())
+			for i, row := range a {
+				result[i] = []interface{}{scalar(c, c.invoke(fn, Array{row}))}
+			}
+			return result, nil
+		},
+	},
+	{
+		Name: "COLUMNS",
+		Params: []Param{
+			{Name: "a", Type: TypeArray},
+		},
+		Returns:     TypeNumber,
+		Description: "Returns the number of columns of a.",
+		Examples:    []string{`=COLUMNS({1; 2; 3})`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			return float64(c.Values[0].(Array).Columns()), nil
+		},
+	},
+	{
+		Name: "INDEX",
+		Params: []Param{
+			{Name: "a", Type: TypeArray},
+			{Name: "row", Type: TypeNumber},
+			{Name: "column", Type: TypeNumber, Optional: true},
+		},
+		Returns:     TypeAny,
+		Description: "Returns the element of a at row and column, counting from 1. If column is omitted, it is 1, unless a has one row, in which case row is the column of the element.",
+		Examples:    []string{`=INDEX({1; 2 | 3; 4}; 2; 1)`, `=INDEX({"a"; "b"; "c"}; 3)`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			a := c.Values[0].(Array)
+			row, column := c.Number(1), c.OptNumber(2, 1)
+			if a.Rows() == 1 && len(c.Values) == 2 {
+				row, column = 1, row
+			}
+			if !(row >= 1 && row < float64(a.Rows())+1 && column >= 1 && column < float64(a.Columns())+1) {
+				panic(&RuntimeError{Message: "INDEX out of range", Kind: ErrInvalidArgument})
+			}
+			return a[int(row)-1][int(column)-1], nil
+		},
+	},
+	{
+		Name: "MAKEARRAY",
+		Params: []Param{
+			{Name: "rows", Type: TypeNumber},
+			{Name: "columns", Type: TypeNumber},
+			{Name: "fn", Type: TypeFunction},
+		},
+		Returns:     TypeArray,
+		Description: "Returns an array of rows by columns elements, each of which is the result of calling fn with its row and column, counting from 1.",
+		Examples:    []string{`=MAKEARRAY(2; 3; LAMBDA(r; c; r * c))`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			rows, columns := math.Floor(c.Number(0)), math.Floor(c.Number(1))
+			fn := c.Values[2].(Func)
+			if !(rows >= 1 && columns >= 1) {
+				panic(&RuntimeError{Message: "MAKEARRAY dimensions must be positive", Kind: ErrInvalidArgument})
+			}
+			// the size is computed as a float64, which cannot overflow
+			if !(rows*columns < maxIntFloat) {
+				panic(&RuntimeError{Message: "MAKEARRAY result is too large", Kind: ErrLimitExceeded})
+			}
+			checkArraySize(c.Context(), int(rows*columns))
+			// the array grows as fn is called, so that the limits of the
+			// evaluation apply before a large array is allocated
+			var a Array
+			for i := 0; i < int(rows); i++ {
+				var row []interface{}
+				for j := 0; j < int(columns); j++ {
+					row = append(row, scalar(c, c.invoke(fn, float64(i+1), float64(j+1))))
+				}
+				a = append(a, row)
+			}
+			return a, nil
+		},
+	},
+	{
+		Name: "MAP",
+		Params: []Param{
+			{Name: "a", Type: TypeArray},
+			{Type: TypeAny, Variadic: true},
+		},
+		Returns:     TypeArray,
+		Description: "Returns an array of the results of calling the last argument, a function, with each element of a and the corresponding elements of the arrays that follow a, which must have the same dimensions as a.",
+		Examples:    []string{`=MAP({1; 2 | 3; 4}; LAMBDA(x; x * 10))`, `=MAP({1; 2}; {3; 4}; LAMBDA(x; y; x + y))`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			if len(c.Values) < 2 {
+				panic(&RuntimeError{Message: c.Name + " expects at least 2 arguments", Kind: ErrArgumentCount})
+			}
+			last := len(c.Values) - 1
+			fn, ok := c.Values[last].(Func)
+			if !ok {
+				panic(&RuntimeError{Message: c.Name + " expects argument " + strconv.Itoa(last) + " to be function", Kind: ErrTypeMismatch})
+			}
+			arrays := make([]Array, last)
+			for i := range arrays {
+				if arrays[i], ok = c.Values[i].(Array); !ok {
+					panic(&RuntimeError{Message: c.Name + " expects argument " + strconv.Itoa(i) + " to be array", Kind: ErrTypeMismatch})
+				}
+				if arrays[i].Rows() != arrays[0].Rows() || arrays[i].Columns() != arrays[0].Columns() {
+					panic(&RuntimeError{Message: c.Name + " expects arrays of the same dimensions", Kind: ErrInvalidArgument})
+				}
+			}
+			result := make(Array, arrays[0].Rows())
+			args := make([]interface{}, len(arrays))
+			for i := range result {
+				result[i] = make([]interface{}, arrays[0].Columns())
+				for j := range result[i] {
+					for k, a := range arrays {
+						args[k] = a[i][j]
+					}
+					result[i][j] = scalar(c, c.invoke(fn, append([]interface{}(nil), args...)...))
+				}
+			}
+			return result, nil
+		},
+	},
+	{
+		Name: "REDUCE",
+		Params: []Param{
+			{Name: "initial", Type: TypeAny},
+			{Name: "a", Type: TypeArray},
+			{Name: "fn", Type: TypeFunction},
+		},
+		Returns:     TypeAny,
+		Description: "Returns the result of calling fn with an accumulator and each element of a, row by row. The accumulator is initially initial, and is then the result of the previous call.",
+		Examples:    []string{`=REDUCE(0; {1; 2 | 3; 4}; LAMBDA(sum; x; sum + x))`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			acc := c.Values[0]
+			fn := c.Values[2].(Func)
+			for _, row := range c.Values[1].(Array) {
+				for _, element := range row {
+					acc = c.invoke(fn, acc, element)
+				}
+			}
+			return acc, nil
+		},
+	},
+	{
+		Name: "ROWS",
+		Params: []Param{
+			{Name: "a", Type: TypeArray},
+		},
+		Returns:     TypeNumber,
+		Description: "Returns the number of rows of a.",
+		Examples:    []string{`=ROWS({1; 2 | 3; 4})`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			return float64(c.Values[0].(Array).Rows()), nil
+		},
 	},
+	{
+		Name: "SCAN",
+		Params: []Param{
+			{Name: "initial", Type: TypeAny},
+			{Name: "a", Type: TypeArray},
+			{Name: "fn", Type: TypeFunction},
+		},
+		Returns:     TypeArray,
+		Description: "Returns an array of the same dimensions as a, which contains each intermediate value of the accumulator of REDUCE(initial; a; fn).",
+		Examples:    []string{`=SCAN(0; {1; 2; 3}; LAMBDA(sum; x; sum + x))`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			acc := c.Values[0]
+			a := c.Values[1].(Array)
+			fn := c.Values[2].(Func)
+			result := make(Array, a.Rows())
+			for i, row := range a {
+				result[i] = make([]interface{}, len(row))
+				for j, element := range row {
+					acc = scalar(c, c.invoke(fn, acc, element))
+					result[i][j] = acc
+				}
+			}
+			return result, nil
+		},
+	},
+
+	// JSON
+	{
+		Name: "JSONPATH",
+		Params: []Param{
+			{Name: "doc", Type: TypeAny},
+			{Name: "path", Type: TypeString},
+		},
+		Returns:     TypeAny,
+		Description: "Returns the value at path, which has the form $.member[index]['member'], in doc, a JSON document or a record or array. Objects are returned as records and arrays as arrays.",
+		Examples:    []string{`=JSONPATH("{\"a\": [1, 2]}"; "$.a[1]")`},
+		Pure:        true,
+		Func:        jsonPath,
+	},
+}
+
+var baseSource = funcDefSource(baseFuncs)
+
+// funcDefSource returns a SourceMap that contains defs, keyed by name.
+func funcDefSource(defs []*FuncDef) SourceMap {
+	m := make(SourceMap, len(defs))
+	for _, def := range defs {
+		m[def.Name] = def
+	}
+	return m
+}
+
+// maxIntFloat is one more than the largest int, as a float64. Smaller
+// float64 values can be converted to int without overflowing.
+const maxIntFloat = float64(int(^uint(0)>>1)) + 1
+
+// scalar returns value, the result of a function called by c, which must not
+// be an array.
+func scalar(c *Call, value interface{}) interface{} {
+	if _, ok := value.(Array); ok {
+		panic(&RuntimeError{Message: c.Name + " expects the function to return a single value, not an array", Kind: ErrTypeMismatch})
+	}
+	return value
 }
 
 // Base contains the base functions, as described in the package documentation.
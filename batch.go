@@ -0,0 +1,110 @@
+package exprel
+
+import (
+	"context"
+)
+
+// BatchSource is a Source that can look up many identifiers at once.
+type BatchSource interface {
+	Source
+	// GetMany returns the values of the given identifiers. Identifiers that do
+	// not exist are omitted from values.
+	GetMany(ctx context.Context, names []string) (values map[string]interface{}, err error)
+}
+
+// Identifiers returns the identifiers that are referenced by the expression,
+// in order of first appearance. Function names and names bound by LET and
+// LAMBDA are not included.
+func (e *Expression) Identifiers() []string {
+	var names []string
+	seen := make(map[string]bool)
+	references(e.node, func(name string, call bool, span Span) {
+		if !call && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	})
+	return names
+}
+
+// EvaluatePrefetch is like EvaluateContext, but all of the expression's
+// identifiers are fetched from s, using a single call to GetMany, before the
+// expression is evaluated. Function names continue to be looked up using
+// s.Get.
+func (e *Expression) EvaluatePrefetch(ctx context.Context, s BatchSource) (interface{}, error) {
+	names := e.Identifiers()
+	if len(names) == 0 {
+		return e.EvaluateContext(ctx, s)
+	}
+	values, err := s.GetMany(ctx, names)
+	if err != nil {
+		return nil, &RuntimeError{Err: err, Kind: ErrSource}
+	}
+	prefetched := &prefetchSource{
+		Fetched: make(map[string]bool, len(names)),
+		Values:  values,
+		Source:  s,
+	}
+	for _, name := range names {
+		prefetched.Fetched[name] = true
+	}
+	return e.EvaluateContext(ctx, prefetched)
+}
+
+// prefetchSource is a Source whose identifiers have been fetched in advance.
+type prefetchSource struct {
+	Fetched map[string]bool
+	Values  map[string]interface{}
+	Source  Source
+}
+
+func (s *prefetchSource) Get(ctx context.Context, name string) (interface{}, bool) {
+	if value, ok := s.Values[name]; ok {
+		return value, true
+	}
+	if s.Fetched[name] {
+		return nil, false
+	}
+	return s.Source.Get(ctx, name)
+}
+
+// Names implements EnumerableSource.
+func (s *prefetchSource) Names() []string {
+	return sourceNames(s.Source)
+}
+
+// GetMany implements BatchSource. Each name is resolved by the first Source
+// that contains it. Sources that implement BatchSource are queried with a
+// single call to GetMany.
+func (s Sources) GetMany(ctx context.Context, names []string) (map[string]interface{}, error) {
+	values := make(map[string]interface{}, len(names))
+	remaining := names
+	for _, source := range s {
+		if len(remaining) == 0 {
+			break
+		}
+		if batch, ok := source.(BatchSource); ok {
+			found, err := batch.GetMany(ctx, remaining)
+			if err != nil {
+				return nil, err
+			}
+			for name, value := range found {
+				values[name] = value
+			}
+		} else {
+			for _, name := range remaining {
+				if value, ok := source.Get(ctx, name); ok {
+					values[name] = value
+				}
+			}
+		}
+		var next []string
+		for _, name := range remaining {
+			if _, ok := values[name]; !ok {
+				next = append(next, name)
+			}
+		}
+		remaining = next
+	}
+	return values, nil
+}
@@ -0,0 +1,138 @@
+package exprel
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CachingSource is a Source that memoizes the values returned by another
+// Source. Values are cached for the duration of each expression evaluation,
+// and, if a TTL is given, across evaluations until the TTL expires.
+//
+// A CachingSource is safe for concurrent use.
+type CachingSource struct {
+	hits   uint64
+	misses uint64
+
+	source Source
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	Value   interface{}
+	OK      bool
+	Expires time.Time
+}
+
+// CacheStats contains the number of lookups that were, and were not, served
+// from a CachingSource's cache.
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// CachedSource returns a Source that caches the values returned by s for the
+// duration of each expression evaluation.
+func CachedSource(s Source) *CachingSource {
+	return &CachingSource{
+		source: s,
+	}
+}
+
+// CachedSourceTTL is like CachedSource, but values are also cached across
+// evaluations for the duration ttl.
+func CachedSourceTTL(s Source, ttl time.Duration) *CachingSource {
+	return &CachingSource{
+		source:  s,
+		ttl:     ttl,
+		entries: make(map[string]cacheEntry),
+	}
+}
+
+// Get implements Source. Both found and missing identifiers are cached.
+func (c *CachingSource) Get(ctx context.Context, name string) (interface{}, bool) {
+	ev := evaluationFrom(ctx)
+	if ev != nil {
+		ev.mu.Lock()
+		entry, ok := ev.caches[c][name]
+		ev.mu.Unlock()
+		if ok {
+			atomic.AddUint64(&c.hits, 1)
+			return entry.Value, entry.OK
+		}
+	}
+
+	var now time.Time
+	if c.ttl > 0 {
+		now = time.Now()
+		c.mu.Lock()
+		entry, ok := c.entries[name]
+		c.mu.Unlock()
+		if ok && now.Before(entry.Expires) {
+			atomic.AddUint64(&c.hits, 1)
+			c.store(ev, name, entry)
+			return entry.Value, entry.OK
+		}
+	}
+
+	atomic.AddUint64(&c.misses, 1)
+	value, ok := c.source.Get(ctx, name)
+	entry := cacheEntry{
+		Value: value,
+		OK:    ok,
+	}
+	if c.ttl > 0 {
+		entry.Expires = now.Add(c.ttl)
+		c.mu.Lock()
+		c.entries[name] = entry
+		c.mu.Unlock()
+	}
+	c.store(ev, name, entry)
+	return value, ok
+}
+
+// Names implements EnumerableSource, if the wrapped Source does.
+func (c *CachingSource) Names() []string {
+	return sourceNames(c.source)
+}
+
+// store adds entry to the per-evaluation cache of ev.
+func (c *CachingSource) store(ev *evaluation, name string, entry cacheEntry) {
+	if ev == nil {
+		return
+	}
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	if ev.caches == nil {
+		ev.caches = make(map[*CachingSource]map[string]cacheEntry)
+	}
+	entries := ev.caches[c]
+	if entries == nil {
+		entries = make(map[string]cacheEntry)
+		ev.caches[c] = entries
+	}
+	entries[name] = entry
+}
+
+// Stats returns the cache statistics of c.
+func (c *CachingSource) Stats() CacheStats {
+	return CacheStats{
+		Hits:   atomic.LoadUint64(&c.hits),
+		Misses: atomic.LoadUint64(&c.misses),
+	}
+}
+
+// Purge removes all values that are cached across evaluations.
+func (c *CachingSource) Purge() {
+	if c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	c.entries = make(map[string]cacheEntry)
+	c.mu.Unlock()
+}
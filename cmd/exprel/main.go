@@ -1,6 +1,7 @@
 package main // import "layeh.com/exprel/cmd/exprel"
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
@@ -14,17 +15,42 @@ func main() {
 		flag.PrintDefaults()
 		fmt.Fprint(os.Stderr, "\nEvaluates and prints the result of each expression.\n")
 	}
+	funcs := flag.Bool("funcs", false, "print the documentation of the base functions")
+	explain := flag.Bool("explain", false, "print each expression annotated with intermediate results")
 	flag.Parse()
 
+	if *funcs {
+		fmt.Print(exprel.FormatDocs(exprel.FuncDefs(exprel.Base)))
+		return
+	}
+
 	for _, arg := range flag.Args() {
 		expr, err := exprel.Parse(arg)
 		if err != nil {
+			if syntaxErr, ok := err.(*exprel.SyntaxError); ok {
+				fmt.Printf("error: %s\n", syntaxErr.Format(arg))
+				continue
+			}
 			fmt.Printf("error: %s\n", err)
 			continue
 		}
+		if *explain {
+			_, trace, err := expr.EvaluateTrace(context.Background(), exprel.Base)
+			fmt.Println(trace.Explain())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: %s\n", err)
+				os.Exit(1)
+			}
+			continue
+		}
 		result, err := expr.Evaluate(exprel.Base)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			if runtimeErr, ok := err.(*exprel.RuntimeError); ok {
+				if excerpt := runtimeErr.Excerpt(arg); excerpt != "" {
+					fmt.Fprintln(os.Stderr, excerpt)
+				}
+			}
 			os.Exit(1)
 		}
 		fmt.Println(result)
@@ -2,7 +2,9 @@ package exprel
 
 import (
 	"context"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 // Func is a function that can be executed from an Expression.
@@ -18,20 +20,36 @@ type Call struct {
 	ctx context.Context
 }
 
-// Context returns the context for the current function call.
+// Context returns the context for the current function call. If the Call was
+// not created by an evaluating expression, the background context is
+// returned.
 func (c *Call) Context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
 	return c.ctx
 }
 
+// invoke calls fn, a function passed as an argument of c, with args. Like the
+// calls of the expression, the call is canceled with the context of c.
+func (c *Call) invoke(fn Func, args ...interface{}) interface{} {
+	select {
+	case <-c.ctx.Done():
+		panic(&RuntimeError{Err: c.ctx.Err(), Kind: ErrCanceled})
+	default:
+	}
+	return invoke(c.ctx, Span{}, "LAMBDA", fn, args)
+}
+
 // String returns the ith argument, iff it is a string. Otherwise, the function
 // panics with a *RuntimeError.
 func (c *Call) String(i int) string {
 	if len(c.Values) <= i {
-		panic(&RuntimeError{Message: c.Name + " expects argument " + strconv.Itoa(i) + " to be string"})
+		panic(&RuntimeError{Message: c.Name + " expects argument " + strconv.Itoa(i) + " to be string", Kind: ErrTypeMismatch})
 	}
 	value, ok := c.Values[i].(string)
 	if !ok {
-		panic(&RuntimeError{Message: c.Name + " expects argument " + strconv.Itoa(i) + " to be string"})
+		panic(&RuntimeError{Message: c.Name + " expects argument " + strconv.Itoa(i) + " to be string", Kind: ErrTypeMismatch})
 	}
 	return value
 }
@@ -45,7 +63,7 @@ func (c *Call) OptString(i int, def string) string {
 	}
 	value, ok := c.Values[i].(string)
 	if !ok {
-		panic(&RuntimeError{Message: c.Name + " expects argument " + strconv.Itoa(i) + " to be string"})
+		panic(&RuntimeError{Message: c.Name + " expects argument " + strconv.Itoa(i) + " to be string", Kind: ErrTypeMismatch})
 	}
 	return value
 }
@@ -54,11 +72,11 @@ func (c *Call) OptString(i int, def string) string {
 // function panics with a *RuntimeError.
 func (c *Call) Number(i int) float64 {
 	if len(c.Values) <= i {
-		panic(&RuntimeError{Message: c.Name + " expects argument " + strconv.Itoa(i) + " to be number"})
+		panic(&RuntimeError{Message: c.Name + " expects argument " + strconv.Itoa(i) + " to be number", Kind: ErrTypeMismatch})
 	}
 	value, ok := c.Values[i].(float64)
 	if !ok {
-		panic(&RuntimeError{Message: c.Name + " expects argument " + strconv.Itoa(i) + " to be number"})
+		panic(&RuntimeError{Message: c.Name + " expects argument " + strconv.Itoa(i) + " to be number", Kind: ErrTypeMismatch})
 	}
 	return value
 }
@@ -72,7 +90,7 @@ func (c *Call) OptNumber(i int, def float64) float64 {
 	}
 	value, ok := c.Values[i].(float64)
 	if !ok {
-		panic(&RuntimeError{Message: c.Name + " expects argument " + strconv.Itoa(i) + " to be number"})
+		panic(&RuntimeError{Message: c.Name + " expects argument " + strconv.Itoa(i) + " to be number", Kind: ErrTypeMismatch})
 	}
 	return value
 }
@@ -81,11 +99,11 @@ func (c *Call) OptNumber(i int, def float64) float64 {
 // panics with a *RuntimeError.
 func (c *Call) Boolean(i int) bool {
 	if len(c.Values) <= i {
-		panic(&RuntimeError{Message: c.Name + " expects argument " + strconv.Itoa(i) + " to be bool"})
+		panic(&RuntimeError{Message: c.Name + " expects argument " + strconv.Itoa(i) + " to be bool", Kind: ErrTypeMismatch})
 	}
 	value, ok := c.Values[i].(bool)
 	if !ok {
-		panic(&RuntimeError{Message: c.Name + " expects argument " + strconv.Itoa(i) + " to be bool"})
+		panic(&RuntimeError{Message: c.Name + " expects argument " + strconv.Itoa(i) + " to be bool", Kind: ErrTypeMismatch})
 	}
 	return value
 }
@@ -99,17 +117,26 @@ func (c *Call) OptBoolean(i int, def bool) bool {
 	}
 	value, ok := c.Values[i].(bool)
 	if !ok {
-		panic(&RuntimeError{Message: c.Name + " expects argument " + strconv.Itoa(i) + " to be bool"})
+		panic(&RuntimeError{Message: c.Name + " expects argument " + strconv.Itoa(i) + " to be bool", Kind: ErrTypeMismatch})
 	}
 	return value
 }
 
 // Source is a source of data for an expression. Get is called when an
-// identifier needs to be evaluated.
+// identifier needs to be evaluated. The returned value is converted as
+// described by Normalize.
 type Source interface {
 	Get(ctx context.Context, name string) (value interface{}, ok bool)
 }
 
+// EnumerableSource is a Source that can list the identifiers it contains. It
+// is used to suggest alternatives for unknown identifiers and functions.
+type EnumerableSource interface {
+	Source
+	// Names returns the identifiers that the Source contains.
+	Names() []string
+}
+
 // EmptySource is a Source that contains no values.
 var EmptySource Source = emptySource{}
 
@@ -133,15 +160,17 @@ type SourceMap map[string]interface{}
 // Get implements Source.
 func (m SourceMap) Get(ctx context.Context, name string) (interface{}, bool) {
 	value, ok := m[name]
-	if !ok {
-		return nil, false
-	}
-	switch value.(type) {
-	case bool, string, float64, Func:
-		return value, true
-	default:
-		return nil, false
+	return value, ok
+}
+
+// Names implements EnumerableSource. The names are returned in sorted order.
+func (m SourceMap) Names() []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names
 }
 
 // Sources is a slice of sources. The first Source, in order, to return ok,
@@ -158,3 +187,93 @@ func (s Sources) Get(ctx context.Context, name string) (interface{}, bool) {
 	}
 	return nil, false
 }
+
+// Names implements EnumerableSource. It returns the names of the Sources
+// that implement EnumerableSource, without duplicates.
+func (s Sources) Names() []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, source := range s {
+		for _, name := range sourceNames(source) {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// CaseFoldSource returns a Source that wraps s, matching identifiers
+// case-insensitively when s does not contain an exact match.
+//
+// The keys of SourceMaps, including those within Sources, are matched in
+// any case. For other Sources, the uppercase and lowercase forms of an
+// identifier are tried.
+func CaseFoldSource(s Source) Source {
+	switch s := s.(type) {
+	case Sources:
+		folded := make(Sources, len(s))
+		for i, source := range s {
+			folded[i] = CaseFoldSource(source)
+		}
+		return folded
+	case SourceMap:
+		index := make(map[string]string, len(s))
+		for name := range s {
+			folded := strings.ToUpper(name)
+			if existing, ok := index[folded]; !ok || name < existing {
+				index[folded] = name
+			}
+		}
+		return &caseFoldSource{
+			Source: s,
+			Index:  index,
+		}
+	default:
+		return &caseFoldSource{
+			Source: s,
+		}
+	}
+}
+
+type caseFoldSource struct {
+	Source Source
+	// Index maps uppercase names to the names in Source.
+	Index map[string]string
+}
+
+func (s *caseFoldSource) Get(ctx context.Context, name string) (interface{}, bool) {
+	if value, ok := s.Source.Get(ctx, name); ok {
+		return value, true
+	}
+	if s.Index != nil {
+		actual, ok := s.Index[strings.ToUpper(name)]
+		if !ok {
+			return nil, false
+		}
+		return s.Source.Get(ctx, actual)
+	}
+	if upper := strings.ToUpper(name); upper != name {
+		if value, ok := s.Source.Get(ctx, upper); ok {
+			return value, true
+		}
+	}
+	if lower := strings.ToLower(name); lower != name {
+		return s.Source.Get(ctx, lower)
+	}
+	return nil, false
+}
+
+// Names implements EnumerableSource.
+func (s *caseFoldSource) Names() []string {
+	return sourceNames(s.Source)
+}
+
+// sourceNames returns the names of s, if it implements EnumerableSource.
+func sourceNames(s Source) []string {
+	if enumerable, ok := s.(EnumerableSource); ok {
+		return enumerable.Names()
+	}
+	return nil
+}
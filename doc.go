@@ -37,11 +37,54 @@
 //  string
 //  float64 (number)
 //  bool (boolean)
+//  Array (array)
+//  Record (record)
 //
 // Sources may also return the following type, which defines a function that
 // can be called from an expression:
 //  func(c *Call) (value interface{}, err error)
 //
+// A function may instead be returned as a *FuncDef, which describes its
+// parameters, result and behaviour. The arguments of a FuncDef are validated
+// before it is called, and FuncDefs and FormatDocs generate documentation
+// such as the list of functions below.
+//
+// The functions of Base are FuncDefs, so their arguments are validated too.
+// Calling a Base function with more arguments than it accepts (e.g.
+// =ABS(-1; 2)), which earlier versions ignored, fails with an error of kind
+// ErrArgumentCount.
+//
+// Other Go types returned by Sources and functions, such as integers, are
+// converted as described by Normalize.
+//
+// Functions are values: they can be created in an expression with LAMBDA,
+// bound to names with LET, passed to and returned from functions, and invoked
+// by following any term with an argument list:
+//  =LET(add; LAMBDA(a; b; a + b); add(1; 2))  3
+//  =LAMBDA(x; x * 2)(21)                      42
+//
+// User-defined functions may call themselves (e.g. by being passed as an
+// argument) up to a fixed maximum depth.
+//
+// Arrays are two-dimensional. They are written as rows of expressions enclosed
+// in braces; by default, columns are separated by the argument separator and
+// rows by '|' (or by ';' if arguments are separated by ','). Sources may
+// return Go slices, which are converted to arrays. MAP, REDUCE, SCAN,
+// MAKEARRAY, BYROW and BYCOL call a function with the elements, rows or
+// columns of an array:
+//  ={1; 2 | 3; 4}                             {1; 2 | 3; 4}
+//  =MAP({1; 2 | 3; 4}; LAMBDA(x; x * 10))     {10; 20 | 30; 40}
+//  =REDUCE(0; {1; 2; 3}; LAMBDA(a; x; a + x)) 6
+// The operators do not apply to arrays, and arrays cannot contain arrays. The
+// functions called for the elements of an array are subject to the same limits
+// as other calls, including the maximum call depth.
+//
+// Identifiers may contain dots (e.g. Address.City), which sources such as
+// StructSource use to access nested values. Dotted identifiers also access the
+// fields of records, such as the objects of a JSONSource, whether the record
+// is returned by a Source or bound by LET or LAMBDA:
+//  =LET(o; order; o.total * 2)
+//
 // Operators
 //
 // The following operators and built-ins are defined:
@@ -66,20 +109,78 @@
 //  Logical OR        OR(bool...)
 //  Logical NOT       NOT(bool)
 //
+//  Logical XOR       XOR(bool...)
+//
 //  Condition         IF(bool;ANY;ANY)
+//  Conditions        IFS(bool;ANY;bool;ANY...)
+//  Switch            SWITCH(ANY;ANY;ANY...;ANY default?)
+//  Local names       LET(name;ANY;name;ANY...;ANY)
+//  Function          LAMBDA(name...;ANY)
 //
 //  Boolean true      TRUE()
 //  Boolean false     FALSE()
 //
+// IFS returns the value following the first true condition. SWITCH compares its
+// first argument with each case value, returning the result paired with the
+// first equal value, or the optional default. LET binds each name to the value
+// following it; the bound names are visible to the subsequent values and the
+// final expression, which is returned. Only the arguments needed to determine
+// the result of IF, IFS, SWITCH, AND, and OR are evaluated.
+//
+// Built-in and function names are case-sensitive, unless the expression is
+// parsed with ParseOptions.CaseInsensitive.
+//
+// Arguments are separated by semicolons and numbers use a period as the
+// decimal separator, unless other separators are chosen with ParseOptions
+// (e.g. =IF(a > 1.5, 1, 2) or =IF(a > 1,5; 1; 2)). The separators of array
+// columns and rows can be chosen too (e.g. ={1, 2; 3, 4} or ={1 \ 2; 3 \ 4}).
+// Translate converts an expression between such dialects.
+//
+// Built-ins and functions may be called by their localized names (e.g.
+// =WENN(a > 1; LINKS(b); "")) by setting ParseOptions.Locale to one of the
+// predefined locales (LocaleDE, LocaleFR, LocaleES, LocalePT) or a Locale
+// created with NewLocale. MarshalText always writes canonical names;
+// ParseOptions.Format and Translate write localized names.
+//
+// Evaluation errors are *RuntimeErrors. Their cause can be tested with
+// errors.Is against the ErrorKind values (e.g. ErrDivisionByZero,
+// ErrUnknownIdentifier), and RuntimeError.Code returns a stable code for the
+// kind (e.g. "DIVISION_BY_ZERO").
+//
+// Expressions from untrusted users can be evaluated with EvalOptions, which
+// limits the number of evaluation steps and function calls, the call depth, the
+// length of created strings and the size of created arrays. A Policy restricts
+// the functions and identifiers they may use; it is checked when parsing with
+// ParseOptions.Policy, and enforced during evaluation by PolicySource.
+//
+// RAND, NOW and TODAY are volatile functions (VolatileFunc): their results
+// change between evaluations, unless the random seed and clock are fixed with
+// WithSeed and WithClock. Expression.Deterministic reports whether an
+// expression uses volatile functions, e.g. to decide whether its result can
+// be cached.
+//
+// EvaluateTrace records the value of every part of an expression that is
+// evaluated. Trace.Explain shows why an expression returned its result:
+//  AND(x > 5 → TRUE; y = "a" → FALSE) → FALSE
+//
+// Debuggers can observe, pause and abort the evaluation of each part of an
+// expression by passing a Hook to EvaluateContext with WithHook. A Profiler
+// is a Hook that measures the time spent in expressions, functions and
+// identifier lookups; Profiler.WriteProfile exports the measurements for
+// pprof.
+//
 //
 // The following functions are defined as part of Base:
 //  CHOOSE(number index; ANY...) ANY
 //    Returns the index item of the remaining arguments
 //  TYPE(ANY a) number
 //    Identifies the type of a. Types are mapped in the following way:
-//      Number  = 1
-//      String  = 2
-//      Boolean = 4
+//      Number   = 1
+//      String   = 2
+//      Boolean  = 4
+//      Array    = 64
+//      Function = 128
+//      Record   = 256
 //
 //  ABS(number a) number
 //    Returns the absolute value of a.
@@ -119,4 +220,64 @@
 //    Returns a with whitespace removed from the beginning and end.
 //  UPPER(string a) string
 //    Returns a with all lowercase characters transformed to uppercase.
+//
+//  NOW() number
+//    Returns the current date and time as a serial date number.
+//  TODAY() number
+//    Returns the current date as a serial date number.
+//
+//  DOLLAR(number a; number decimals = 2) string
+//    Returns a formatted as currency, rounded to decimals places.
+//  FIXED(number a; number decimals = 2; bool noCommas = FALSE()) string
+//    Returns a rounded to decimals places, with thousands separated by commas
+//    unless noCommas is true.
+//  N(ANY a) number
+//    Returns a if it is a number, 1 or 0 if it is a boolean, and 0 otherwise.
+//  NUMBERVALUE(string a; string decimal = "."; string group = ",") number
+//    Returns the number represented by a, using the given decimal and group
+//    separators. Trailing percent signs divide the number by 100.
+//  T(ANY a) string
+//    Returns a if it is a string, and "" otherwise.
+//  TEXT(ANY a; string format) string
+//    Returns a formatted using a spreadsheet format code. Number codes (0, #,
+//    ?, ".", ",", %), date codes (y, m, d, h, s, AM/PM) applied to serial
+//    dates, elapsed time codes ([h], [m], [s]), quoted literals and up to four
+//    ';' separated sections are supported.
+//  VALUE(ANY a) number
+//    Returns the number represented by the string a. Numbers are returned
+//    unchanged.
+//
+//  BYCOL(array a; function fn) array
+//    Returns an array with one row, containing the results of calling fn with
+//    each column of a.
+//  BYROW(array a; function fn) array
+//    Returns an array with one column, containing the results of calling fn
+//    with each row of a.
+//  COLUMNS(array a) number
+//    Returns the number of columns of a.
+//  INDEX(array a; number row; [number column]) ANY
+//    Returns the element of a at row and column, counting from 1. If column is
+//    omitted, it is 1, unless a has one row, in which case row is the column of
+//    the element.
+//  MAKEARRAY(number rows; number columns; function fn) array
+//    Returns an array of rows by columns elements, each of which is the result
+//    of calling fn with its row and column, counting from 1.
+//  MAP(array a; ANY...) array
+//    Returns an array of the results of calling the last argument, a function,
+//    with each element of a and the corresponding elements of the arrays that
+//    follow a, which must have the same dimensions as a.
+//  REDUCE(ANY initial; array a; function fn) ANY
+//    Returns the result of calling fn with an accumulator and each element of
+//    a, row by row. The accumulator is initially initial, and is then the
+//    result of the previous call.
+//  ROWS(array a) number
+//    Returns the number of rows of a.
+//  SCAN(ANY initial; array a; function fn) array
+//    Returns an array of the same dimensions as a, which contains each
+//    intermediate value of the accumulator of REDUCE(initial; a; fn).
+//
+//  JSONPATH(ANY doc; string path) ANY
+//    Returns the value at path, which has the form $.member[index]['member'],
+//    in doc, a JSON document or a record or array. Objects are returned as
+//    records and arrays as arrays.
 package exprel // import "layeh.com/exprel"
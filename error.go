@@ -2,24 +2,142 @@ package exprel
 
 import (
 	"fmt"
+	"runtime"
+	"strings"
+	"unicode/utf8"
 )
 
 // SyntaxError represents an error that is triggered when parsing an
 // expression.
 type SyntaxError struct {
-	Message  string
+	Message string
+	// Position is the byte offset of the error in the source.
 	Position int
+	// Line and Column are the 1-based line and column of Position. Columns are
+	// counted in runes.
+	Line   int
+	Column int
+	// Expected describes the tokens that would have been valid at Position
+	// (e.g. "';'", "')'", "expression"). It is nil if the error is not caused by
+	// an unexpected token.
+	Expected []string
 }
 
 func (e *SyntaxError) Error() string {
-	return fmt.Sprintf("exprel: syntax error near index %d: %s", e.Position, e.Message)
+	return fmt.Sprintf("exprel: syntax error at line %d, column %d: %s", e.Line, e.Column, e.Message)
+}
+
+// Format returns a report of the error that includes the line of the parsed
+// source that contains the error, with a caret pointing to its position:
+//  exprel: syntax error at line 1, column 8: unexpected EOF, expecting ';' or ')'
+//  =IF(1;2
+//         ^
+func (e *SyntaxError) Format(source string) string {
+	return e.Error() + "\n" + excerpt(source, Span{e.Position, e.Position})
+}
+
+// locate sets the line and column of the error in source.
+func (e *SyntaxError) locate(source string) {
+	if e.Position > len(source) {
+		e.Position = len(source)
+	}
+	before := source[:e.Position]
+	e.Line = strings.Count(before, "\n") + 1
+	e.Column = utf8.RuneCountInString(before[strings.LastIndexByte(before, '\n')+1:]) + 1
 }
 
+// Span is the range of byte offsets [Start, End) of a part of an expression's
+// source.
+type Span struct {
+	Start int
+	End   int
+}
+
+func (s Span) span() Span {
+	return s
+}
+
+// ErrorKind identifies the cause of a RuntimeError. Use errors.Is to test the
+// kind of an error:
+//  if errors.Is(err, exprel.ErrDivisionByZero) {
+//    ...
+//  }
+type ErrorKind struct {
+	// Code is a stable identifier for the kind, which is suitable for use in
+	// APIs (e.g. "DIVISION_BY_ZERO").
+	Code string
+
+	description string
+}
+
+func (k *ErrorKind) Error() string {
+	return "exprel: " + k.description
+}
+
+// Kinds of RuntimeError.
+var (
+	// ErrDivisionByZero is the kind of errors caused by dividing by zero.
+	ErrDivisionByZero = &ErrorKind{"DIVISION_BY_ZERO", "division by zero"}
+	// ErrUnknownIdentifier is the kind of errors caused by identifiers that
+	// are not found in the Source.
+	ErrUnknownIdentifier = &ErrorKind{"UNKNOWN_IDENTIFIER", "unknown identifier"}
+	// ErrUnknownFunction is the kind of errors caused by calls to functions
+	// that are not found in the Source.
+	ErrUnknownFunction = &ErrorKind{"UNKNOWN_FUNCTION", "unknown function"}
+	// ErrTypeMismatch is the kind of errors caused by values of the wrong
+	// type, such as operands, arguments and values returned by Sources.
+	ErrTypeMismatch = &ErrorKind{"TYPE_MISMATCH", "type mismatch"}
+	// ErrArgumentCount is the kind of errors caused by calling a function with
+	// the wrong number of arguments.
+	ErrArgumentCount = &ErrorKind{"ARGUMENT_COUNT", "wrong number of arguments"}
+	// ErrInvalidArgument is the kind of errors caused by arguments of the
+	// correct type that a function cannot accept (e.g. VALUE("abc")).
+	ErrInvalidArgument = &ErrorKind{"INVALID_ARGUMENT", "invalid argument"}
+	// ErrNoMatch is the kind of errors caused by IFS and SWITCH expressions
+	// that have no matching case.
+	ErrNoMatch = &ErrorKind{"NO_MATCH", "no matching case"}
+	// ErrCanceled is the kind of errors caused by the evaluation's context
+	// being canceled or exceeding its deadline. Err is the context's error.
+	ErrCanceled = &ErrorKind{"CANCELED", "evaluation canceled"}
+	// ErrLimitExceeded is the kind of errors caused by exceeding a limit on
+	// evaluation, such as the maximum call depth.
+	ErrLimitExceeded = &ErrorKind{"LIMIT_EXCEEDED", "limit exceeded"}
+	// ErrFunction is the kind of errors returned by a function, and of
+	// RuntimeErrors raised by functions without a kind, including Go runtime
+	// panics. Err is the function's error, if any.
+	ErrFunction = &ErrorKind{"FUNCTION", "function failed"}
+	// ErrSource is the kind of errors raised by Sources, such as invalid JSON
+	// documents. Err is the Source's error.
+	ErrSource = &ErrorKind{"SOURCE", "source failed"}
+	// ErrPolicyViolation is the kind of errors caused by using a function or
+	// identifier that is not permitted by a Policy. Err is the *PolicyError.
+	ErrPolicyViolation = &ErrorKind{"POLICY_VIOLATION", "policy violation"}
+	// ErrInvalidExpression is the kind of errors caused by evaluating a part
+	// of an expression that could not be parsed (see ParseRecover).
+	ErrInvalidExpression = &ErrorKind{"INVALID_EXPRESSION", "invalid expression"}
+)
+
 // RuntimeError represents an error that is triggered when evaluating an
 // expression.
 type RuntimeError struct {
 	Message string
 	Err     error
+	// Kind is the cause of the error. It is nil if the error was raised by a
+	// Source without a kind.
+	Kind *ErrorKind
+
+	// Span is the location of the part of the expression that failed. It is
+	// the zero Span if the location is unknown.
+	Span Span
+	// Function is the name of the function or built-in that failed, if any.
+	Function string
+	// Calls is the chain of function calls that were being evaluated when the
+	// error occurred, outermost first.
+	Calls []string
+	// Suggestions contains similar names for an unknown identifier or
+	// function. They are only available from Sources that implement
+	// EnumerableSource.
+	Suggestions []string
 }
 
 func (e *RuntimeError) Error() string {
@@ -28,3 +146,100 @@ func (e *RuntimeError) Error() string {
 	}
 	return fmt.Sprintf("exprel: runtime error: %s", e.Message)
 }
+
+// Unwrap returns Err.
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the kind of e.
+func (e *RuntimeError) Is(target error) bool {
+	return e.Kind != nil && target == error(e.Kind)
+}
+
+// Code returns the code of the kind of e, or "" if e has no kind.
+func (e *RuntimeError) Code() string {
+	if e.Kind == nil {
+		return ""
+	}
+	return e.Kind.Code
+}
+
+// recoveredError returns rec, a value recovered from a panic during
+// evaluation, as a *RuntimeError. Go runtime panics (e.g. an index out of
+// range in a Func) are converted to errors of kind ErrFunction. ok is false if
+// rec is neither.
+func recoveredError(rec interface{}) (err *RuntimeError, ok bool) {
+	switch rec := rec.(type) {
+	case *RuntimeError:
+		return rec, true
+	case runtime.Error:
+		return &RuntimeError{Err: rec, Kind: ErrFunction}, true
+	}
+	return nil, false
+}
+
+// enter records that the error occurred during a call to name at span.
+func (e *RuntimeError) enter(span Span, name string) {
+	if e.Kind == nil {
+		e.Kind = ErrFunction
+	}
+	if e.Span == (Span{}) {
+		e.Span = span
+	}
+	if e.Function == "" {
+		e.Function = name
+	}
+	e.Calls = append([]string{name}, e.Calls...)
+}
+
+// Excerpt returns the line of the expression's source that contains the
+// error, followed by a line that underlines the location of the error with
+// carets:
+//  =IF(a = "x"; 1; 2)
+//      ^^^^^^^
+// An empty string is returned if the location of the error is unknown.
+func (e *RuntimeError) Excerpt(source string) string {
+	if e.Span == (Span{}) {
+		return ""
+	}
+	return excerpt(source, e.Span)
+}
+
+// excerpt returns the line of source that contains span.Start, followed by a
+// line that underlines span.
+func excerpt(source string, span Span) string {
+	if span.Start > len(source) {
+		span.Start = len(source)
+	}
+	if span.End < span.Start {
+		span.End = span.Start
+	}
+	lineStart := strings.LastIndexByte(source[:span.Start], '\n') + 1
+	lineEnd := len(source)
+	if i := strings.IndexByte(source[span.Start:], '\n'); i >= 0 {
+		lineEnd = span.Start + i
+	}
+	line := strings.TrimSuffix(source[lineStart:lineEnd], "\r")
+	if span.End > lineStart+len(line) {
+		span.End = lineStart + len(line)
+	}
+
+	var b strings.Builder
+	b.WriteString(line)
+	b.WriteByte('\n')
+	for _, r := range source[lineStart:span.Start] {
+		// preserve tabs so that the carets line up
+		if r == '\t' {
+			b.WriteByte('\t')
+		} else {
+			b.WriteByte(' ')
+		}
+	}
+	carets := utf8.RuneCountInString(source[span.Start:span.End])
+	if carets == 0 {
+		carets = 1
+	}
+	b.WriteString(strings.Repeat("^", carets))
+	return b.String()
+}
@@ -1,9 +1,12 @@
 package exprel
 
 import (
-	"bytes"
 	"context"
 	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Expression is an user-defined expression that can be evaluated.
@@ -11,27 +14,167 @@ type Expression struct {
 	node node
 }
 
+// ParseOptions configures how an expression is parsed. The zero value
+// contains the default options.
+type ParseOptions struct {
+	// CaseInsensitive enables case-insensitive matching of built-ins (e.g. IF,
+	// AND) and function names. Function names are converted to uppercase,
+	// unless they refer to a name bound by LET or LAMBDA. Names bound by LET
+	// and LAMBDA are also matched case-insensitively.
+	CaseInsensitive bool
+
+	// ArgumentSeparator separates function arguments. It must be ';' (the
+	// default) or ','.
+	ArgumentSeparator rune
+	// DecimalSeparator separates the integer and fractional parts of a number.
+	// It must be '.' (the default) or ',', and must differ from
+	// ArgumentSeparator.
+	DecimalSeparator rune
+	// ArrayColumnSeparator separates the columns of array literals. It must
+	// be ';', ',', '|' or '\\'. The default is ArgumentSeparator.
+	ArrayColumnSeparator rune
+	// ArrayRowSeparator separates the rows of array literals. It must be ';',
+	// ',', '|' or '\\', and must differ from ArrayColumnSeparator. The default
+	// is '|' if columns are separated by ';', and ';' otherwise.
+	ArrayRowSeparator rune
+
+	// Locale, if non-nil, allows built-ins and functions to be called using
+	// their localized names (e.g. WENN instead of IF).
+	Locale *Locale
+
+	// Policy, if non-nil, is checked against the parsed expression. Parse
+	// returns a *PolicyError if the expression uses a function or identifier
+	// that is not permitted.
+	Policy *Policy
+}
+
+func (o ParseOptions) argumentSeparator() rune {
+	if o.ArgumentSeparator == 0 {
+		return tknSep
+	}
+	return o.ArgumentSeparator
+}
+
+func (o ParseOptions) decimalSeparator() rune {
+	if o.DecimalSeparator == 0 {
+		return '.'
+	}
+	return o.DecimalSeparator
+}
+
+func (o ParseOptions) arrayColumnSeparator() rune {
+	if o.ArrayColumnSeparator == 0 {
+		return o.argumentSeparator()
+	}
+	return o.ArrayColumnSeparator
+}
+
+func (o ParseOptions) arrayRowSeparator() rune {
+	if o.ArrayRowSeparator != 0 {
+		return o.ArrayRowSeparator
+	}
+	if o.arrayColumnSeparator() == ';' {
+		return '|'
+	}
+	return ';'
+}
+
+func (o ParseOptions) validate() error {
+	sep, decimal := o.argumentSeparator(), o.decimalSeparator()
+	if sep != ';' && sep != ',' {
+		return errors.New("exprel: invalid argument separator '" + string(sep) + "'")
+	}
+	if decimal != '.' && decimal != ',' {
+		return errors.New("exprel: invalid decimal separator '" + string(decimal) + "'")
+	}
+	if sep == decimal {
+		return errors.New("exprel: argument and decimal separators must differ")
+	}
+	column, row := o.arrayColumnSeparator(), o.arrayRowSeparator()
+	for _, r := range []rune{column, row} {
+		if r != ';' && r != ',' && r != '|' && r != '\\' {
+			return errors.New("exprel: invalid array separator '" + string(r) + "'")
+		}
+		if r == decimal {
+			return errors.New("exprel: array and decimal separators must differ")
+		}
+	}
+	if column == row {
+		return errors.New("exprel: array column and row separators must differ")
+	}
+	return nil
+}
+
 // Parse returned a new, executable expression from s. The syntax of s is
 // outlined in the package documentation.
 //
 // Upon success, expression and nil are returned.  Upon failure, nil and error
 // are returned.
 func Parse(s string) (*Expression, error) {
+	return ParseOptions{}.Parse(s)
+}
+
+// Parse is like the package-level Parse, but parses s using the options in o.
+func (o ParseOptions) Parse(s string) (*Expression, error) {
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+
 	// simple expression; nothing to parse
 	if len(s) == 0 || s[0] != '=' {
 		return &Expression{
-			node: stringNode(s),
+			node: &stringNode{Span{0, len(s)}, s},
 		}, nil
 	}
 
-	n, err := parseString(s[1:])
+	n, err := parseString(s, o)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Expression{
+	e := &Expression{
 		node: n,
-	}, nil
+	}
+	if o.Policy != nil {
+		if err := o.Policy.Check(e); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// ParseRecover is like Parse, but does not stop at the first syntax error. It
+// is intended for editors, which report every error in an expression at once.
+//
+// The returned expression contains the parts of s that could be parsed. Each
+// part that could not be parsed, up to the next argument separator or closing
+// parenthesis, fails with a *RuntimeError when evaluated. All syntax errors are
+// returned, in the order in which they were found.
+//
+// A non-nil error is returned if o is invalid, or, if o.Policy is non-nil, a
+// *PolicyError if the parts of s that could be parsed use a function or
+// identifier that is not permitted. The expression and syntax errors are
+// returned with a *PolicyError, so that editors can report it with the syntax
+// errors.
+func (o ParseOptions) ParseRecover(s string) (*Expression, []*SyntaxError, error) {
+	if err := o.validate(); err != nil {
+		return nil, nil, err
+	}
+	if len(s) == 0 || s[0] != '=' {
+		return &Expression{
+			node: &stringNode{Span{0, len(s)}, s},
+		}, nil, nil
+	}
+	n, errs := parseRecover(s, o)
+	e := &Expression{
+		node: n,
+	}
+	if o.Policy != nil {
+		if err := o.Policy.Check(e); err != nil {
+			return e, errs, err
+		}
+	}
+	return e, errs, nil
 }
 
 // Evaluate is a wrapper around EvaluateContext that uses the background context.
@@ -44,16 +187,162 @@ func (e *Expression) Evaluate(s Source) (val interface{}, err error) {
 // Upon success, value and nil are returned. Upon failure, nil and error are
 // returned.
 func (e *Expression) EvaluateContext(ctx context.Context, s Source) (val interface{}, err error) {
+	return EvalOptions{}.EvaluateContext(ctx, e, s)
+}
+
+// EvalOptions configures how an expression is evaluated. The zero value
+// contains the default options, which only limit the call depth, the length
+// of created strings and the size of created arrays.
+//
+// An evaluation that exceeds a limit fails with a *RuntimeError of kind
+// ErrLimitExceeded.
+type EvalOptions struct {
+	// MaxSteps is the maximum number of nodes (literals, operators, calls,
+	// etc.) that are evaluated. Zero means no limit.
+	MaxSteps int
+	// MaxCalls is the maximum number of function calls, including calls to
+	// functions defined with LAMBDA. Zero means no limit.
+	MaxCalls int
+	// MaxCallDepth is the maximum depth of nested calls to functions defined
+	// with LAMBDA or a Library. Zero, or a value larger than the default,
+	// means the default depth of 1024.
+	MaxCallDepth int
+	// MaxStringLength is the maximum length, in bytes, of a string created
+	// by the expression. Zero, or a value larger than the default, means the
+	// default length of 64 MiB.
+	MaxStringLength int
+	// MaxArraySize is the maximum number of elements of an array created by
+	// the expression. Zero, or a value larger than the default, means the
+	// default size of 4194304 (2^22) elements.
+	MaxArraySize int
+}
+
+const (
+	// maximumStringLength and maximumArraySize are the default limits of
+	// EvalOptions, which keep an expression from exhausting memory.
+	maximumStringLength = 1 << 26
+	maximumArraySize    = 1 << 22
+)
+
+// Evaluate is a wrapper around EvaluateContext that uses the background
+// context.
+func (o EvalOptions) Evaluate(e *Expression, s Source) (interface{}, error) {
+	return o.EvaluateContext(context.Background(), e, s)
+}
+
+// EvaluateContext is like Expression.EvaluateContext, but evaluates e using
+// the options in o.
+func (o EvalOptions) EvaluateContext(ctx context.Context, e *Expression, s Source) (val interface{}, err error) {
+	return e.evaluate(ctx, s, &evaluation{opts: o})
+}
+
+// evaluate evaluates e with the given source, using ev to hold the state of
+// the evaluation.
+func (e *Expression) evaluate(ctx context.Context, s Source, ev *evaluation) (val interface{}, err error) {
+	if h := hookFrom(ctx); h != nil {
+		ev.hook = addHook(h, ev.hook)
+	}
+	ev.source = s
+	ctx = context.WithValue(ctx, evaluationKey, ev)
 	defer func() {
 		if rec := recover(); rec != nil {
-			if runtimeErr, ok := rec.(*RuntimeError); ok {
+			if runtimeErr, ok := recoveredError(rec); ok {
+				if policyErr, ok := runtimeErr.Err.(*PolicyError); ok && policyErr.Span == (Span{}) {
+					policyErr.Span = runtimeErr.Span
+				}
 				err = runtimeErr
 				return
 			}
 			panic(rec)
 		}
 	}()
-	return e.node.Evaluate(ctx, s), nil
+	return evaluate(ctx, e.node, s), nil
+}
+
+// evaluation holds state that is scoped to a single call to EvaluateContext.
+type evaluation struct {
+	opts EvalOptions
+	// source is the Source with which the expression is evaluated
+	source Source
+	steps  int64
+	calls  int64
+
+	mu     sync.Mutex
+	caches map[*CachingSource]map[string]cacheEntry
+	rand   *rand.Rand
+	now    time.Time
+	// hook is notified of the evaluation of each node, if non-nil
+	hook  Hook
+	depth int
+}
+
+// step records the evaluation of a node. It panics with a *RuntimeError if
+// the maximum number of steps has been reached.
+func (ev *evaluation) step() {
+	if ev == nil || ev.opts.MaxSteps <= 0 {
+		return
+	}
+	if atomic.AddInt64(&ev.steps, 1) > int64(ev.opts.MaxSteps) {
+		panic(&RuntimeError{Message: "maximum number of steps reached", Kind: ErrLimitExceeded})
+	}
+}
+
+// call records a function call. It panics with a *RuntimeError if the maximum
+// number of calls has been reached.
+func (ev *evaluation) call() {
+	if ev == nil || ev.opts.MaxCalls <= 0 {
+		return
+	}
+	if atomic.AddInt64(&ev.calls, 1) > int64(ev.opts.MaxCalls) {
+		panic(&RuntimeError{Message: "maximum number of calls reached", Kind: ErrLimitExceeded})
+	}
+}
+
+// maxCallDepth returns the maximum call depth of the evaluation.
+func (ev *evaluation) maxCallDepth() int {
+	if ev == nil || ev.opts.MaxCallDepth <= 0 || ev.opts.MaxCallDepth > maximumDepth {
+		return maximumDepth
+	}
+	return ev.opts.MaxCallDepth
+}
+
+// maxStringLength returns the maximum string length of the evaluation.
+func (ev *evaluation) maxStringLength() int {
+	if ev == nil || ev.opts.MaxStringLength <= 0 || ev.opts.MaxStringLength > maximumStringLength {
+		return maximumStringLength
+	}
+	return ev.opts.MaxStringLength
+}
+
+// maxArraySize returns the maximum array size of the evaluation.
+func (ev *evaluation) maxArraySize() int {
+	if ev == nil || ev.opts.MaxArraySize <= 0 || ev.opts.MaxArraySize > maximumArraySize {
+		return maximumArraySize
+	}
+	return ev.opts.MaxArraySize
+}
+
+// checkStringLength panics with a *RuntimeError if a string of n bytes would
+// exceed the maximum string length of the evaluation in ctx.
+func checkStringLength(ctx context.Context, n int) {
+	if n > evaluationFrom(ctx).maxStringLength() {
+		panic(&RuntimeError{Message: "maximum string length exceeded", Kind: ErrLimitExceeded})
+	}
+}
+
+// checkArraySize panics with a *RuntimeError if an array of n elements would
+// exceed the maximum array size of the evaluation in ctx.
+func checkArraySize(ctx context.Context, n int) {
+	if n > evaluationFrom(ctx).maxArraySize() {
+		panic(&RuntimeError{Message: "maximum array size exceeded", Kind: ErrLimitExceeded})
+	}
+}
+
+// evaluationFrom returns the evaluation state of ctx, or nil if ctx is not
+// from an evaluating expression.
+func evaluationFrom(ctx context.Context) *evaluation {
+	ev, _ := ctx.Value(evaluationKey).(*evaluation)
+	return ev
 }
 
 // MarshalText implements encoding.TextMarshaler.
@@ -62,12 +351,36 @@ func (e *Expression) MarshalText() ([]byte, error) {
 		return nil, errors.New("empty expression")
 	}
 
-	var b bytes.Buffer
+	b := newEncoder(ParseOptions{})
 	b.WriteByte('=')
-	e.node.Encode(&b)
+	e.node.Encode(b)
 	return b.Bytes(), nil
 }
 
+// Format returns the textual form of e, using the separators and locale in o.
+func (o ParseOptions) Format(e *Expression) (string, error) {
+	if err := o.validate(); err != nil {
+		return "", err
+	}
+	if str, ok := e.node.(*stringNode); ok && (len(str.Value) == 0 || str.Value[0] != '=') {
+		return str.Value, nil
+	}
+	b := newEncoder(o)
+	b.WriteByte('=')
+	e.node.Encode(b)
+	return b.String(), nil
+}
+
+// Translate converts the expression s from the syntax described by from to
+// the syntax described by to.
+func Translate(s string, from, to ParseOptions) (string, error) {
+	e, err := from.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	return to.Format(e)
+}
+
 // UnmarshalText implements encoding.TextUnmarshaler.
 func (e *Expression) UnmarshalText(text []byte) error {
 	expr, err := Parse(string(text))
@@ -147,6 +460,12 @@ func typename(val interface{}) string {
 		return "boolean"
 	case float64:
 		return "number"
+	case Func:
+		return "function"
+	case Array:
+		return "array"
+	case Record:
+		return "record"
 	}
 	return ""
 }
@@ -2,9 +2,19 @@ package exprel
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
 	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestEmpty(t *testing.T) {
@@ -164,6 +174,749 @@ func TestBuiltinNOT(t *testing.T) {
 	testBool(t, expr, false, nil)
 }
 
+func TestIFS(t *testing.T) {
+	fns := SourceMap{
+		"FUNC": func(*Call) (interface{}, error) {
+			return nil, errors.New("FUNC should not be called")
+		},
+		"x": float64(15),
+	}
+	expr := `=IFS(x > 20; "high"; x > 10; "medium"; FUNC(); "low")`
+	testString(t, expr, "medium", fns)
+
+	expr = `=IFS(x > 20; "high")`
+	testRuntimeError(t, expr, "no true condition", fns)
+
+	expr = `=IFS(x > 20; "high"; TRUE())`
+	testSyntaxError(t, expr, "pairs", fns)
+}
+
+func TestSWITCH(t *testing.T) {
+	fns := SourceMap{
+		"FUNC": func(*Call) (interface{}, error) {
+			return nil, errors.New("FUNC should not be called")
+		},
+		"day": float64(2),
+	}
+	expr := `=SWITCH(day; 1; "Sunday"; 2; "Monday"; FUNC())`
+	testString(t, expr, "Monday", fns)
+
+	expr = `=SWITCH(day; "2"; "string"; 3; "Tuesday"; "other")`
+	testString(t, expr, "other", fns)
+
+	expr = `=SWITCH(day; 1; "Sunday")`
+	testRuntimeError(t, expr, "no matching value", fns)
+}
+
+func TestXOR(t *testing.T) {
+	expr := `=XOR(TRUE(); FALSE(); TRUE())`
+	testBool(t, expr, false, nil)
+
+	expr = `=XOR(TRUE(); 1 = 2)`
+	testBool(t, expr, true, nil)
+}
+
+func TestLET(t *testing.T) {
+	fns := SourceMap{
+		"x": float64(3),
+	}
+	expr := `=LET(a; x * 2; b; a + 1; a * b)`
+	testNumber(t, expr, 42, fns)
+
+	expr = `=LET(x; x + 1; x) + x`
+	testNumber(t, expr, 7, fns)
+
+	expr = `=LET(1; 2; 3)`
+	testSyntaxError(t, expr, "identifier", fns)
+
+	expr = `=LET(a; 2)`
+	testSyntaxError(t, expr, "pairs", fns)
+}
+
+func TestLAMBDA(t *testing.T) {
+	expr := `=LAMBDA(x; x * 2)(21)`
+	testNumber(t, expr, 42, nil)
+
+	expr = `=LET(add; LAMBDA(a; b; a + b); add(1; 2))`
+	testNumber(t, expr, 3, nil)
+
+	expr = `=LET(adder; LAMBDA(a; LAMBDA(b; a + b)); adder(40)(2))`
+	testNumber(t, expr, 42, nil)
+
+	expr = `=LET(n; 5; f; LAMBDA(x; x + n); LET(n; 100; f(1)))`
+	testNumber(t, expr, 6, nil)
+
+	expr = `=LET(fact; LAMBDA(self; n; IF(n <= 1; 1; n * self(self; n - 1))); fact(fact; 5))`
+	testNumber(t, expr, 120, nil)
+
+	expr = `=LAMBDA(x; x)(1; 2)`
+	testRuntimeError(t, expr, "expects 1 arguments", nil)
+
+	expr = `=LAMBDA(x; x; x)`
+	testSyntaxError(t, expr, "duplicate", nil)
+
+	expr = `=LAMBDA(1; 2)`
+	testSyntaxError(t, expr, "identifier", nil)
+
+	expr = `=(1 + 2)(3)`
+	testRuntimeError(t, expr, "non-function", nil)
+}
+
+func TestLAMBDARecursionLimit(t *testing.T) {
+	expr := `=LET(f; LAMBDA(self; n; self(self; n + 1)); f(f; 0))`
+	testRuntimeError(t, expr, "maximum call depth", nil)
+}
+
+func TestLAMBDACanceled(t *testing.T) {
+	e, err := Parse(`=LET(f; LAMBDA(self; n; IF(n = 0; 0; self(self; n - 1))); f(f; 10))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = e.EvaluateContext(ctx, nil)
+	runtimeErr, ok := err.(*RuntimeError)
+	if !ok || runtimeErr.Err != context.Canceled {
+		t.Fatalf("expecting context.Canceled, got %v", err)
+	}
+}
+
+func TestArrays(t *testing.T) {
+	source := Sources{Base, SourceMap{
+		"list":  []int{1, 2, 3},
+		"table": [][]string{{"a", "b"}, {"c", "d"}},
+	}}
+	tests := []struct {
+		Expr     string
+		Expected interface{}
+	}{
+		{`={1; 2 | 3; 4}`, Array{{1.0, 2.0}, {3.0, 4.0}}},
+		{`={"a"; TRUE() | -1; 1 + 1}`, Array{{"a", true}, {-1.0, 2.0}}},
+		{`=list`, Array{{1.0}, {2.0}, {3.0}}},
+		{`=table`, Array{{"a", "b"}, {"c", "d"}}},
+		{`=ROWS(list) * 10 + COLUMNS(list)`, 31.0},
+		{`=INDEX(table; 2; 1)`, "c"},
+		{`=INDEX({"a"; "b"; "c"}; 3)`, "c"},
+		{`=TYPE({1})`, 64.0},
+		{`=MAP({1; 2 | 3; 4}; LAMBDA(x; x * 10))`, Array{{10.0, 20.0}, {30.0, 40.0}}},
+		{`=MAP({1; 2}; {3; 4}; LAMBDA(x; y; x + y))`, Array{{4.0, 6.0}}},
+		{`=MAP({-1; 2}; ABS)`, Array{{1.0, 2.0}}},
+		{`=REDUCE(0; {1; 2 | 3; 4}; LAMBDA(sum; x; sum + x))`, 10.0},
+		{`=REDUCE(""; table; LAMBDA(acc; x; acc & x))`, "abcd"},
+		{`=SCAN(0; {1; 2 | 3; 4}; LAMBDA(sum; x; sum + x))`, Array{{1.0, 3.0}, {6.0, 10.0}}},
+		{`=MAKEARRAY(2; 3; LAMBDA(r; c; r * c))`, Array{{1.0, 2.0, 3.0}, {2.0, 4.0, 6.0}}},
+		{`=BYROW({1; 2 | 3; 4}; LAMBDA(row; INDEX(row; 1) * INDEX(row; 2)))`, Array{{2.0}, {12.0}}},
+		{`=BYCOL({1; 2 | 3; 4}; LAMBDA(col; REDUCE(0; col; LAMBDA(a; b; a + b))))`, Array{{4.0, 6.0}}},
+		{`=LET(double; LAMBDA(a; MAP(a; LAMBDA(x; x * 2))); double(double(list)))`, Array{{4.0}, {8.0}, {12.0}}},
+	}
+	for _, test := range tests {
+		e, err := Parse(test.Expr)
+		if err != nil {
+			t.Fatalf("%s: %s", test.Expr, err)
+		}
+		value, err := e.Evaluate(source)
+		if err != nil {
+			t.Fatalf("%s: %s", test.Expr, err)
+		}
+		if !reflect.DeepEqual(value, test.Expected) {
+			t.Fatalf("%s: expecting %v, got %v", test.Expr, test.Expected, value)
+		}
+	}
+
+	testSyntaxError(t, `={1; 2 | 3}`, "same number of columns", source)
+	testSyntaxError(t, `={}`, "expecting expression", source)
+	testSyntaxError(t, `={1; 2`, "expecting ';', '|' or '}'", source)
+	testRuntimeError(t, `={1; {2}}`, "array cannot contain an array", source)
+	testRuntimeError(t, `=MAP({1; 2}; {1 | 2}; LAMBDA(x; y; x))`, "same dimensions", source)
+	testRuntimeError(t, `=MAP({1; 2}; 3)`, "to be function", source)
+	testRuntimeError(t, `=MAP({1; 2}; LAMBDA(x; y; x))`, "LAMBDA expects 2 arguments", source)
+	testRuntimeError(t, `=BYROW({1; 2}; LAMBDA(row; row))`, "not an array", source)
+	testRuntimeError(t, `=MAKEARRAY(0; 1; LAMBDA(r; c; 1))`, "must be positive", source)
+	testRuntimeError(t, `=INDEX({1; 2}; 3)`, "out of range", source)
+	testRuntimeError(t, `={1} + 1`, "invalid \\+ operands", source)
+	testRuntimeError(t, `=LET(f; LAMBDA(self; n; REDUCE(0; {1}; LAMBDA(a; x; self(self; n + 1)))); f(f; 0))`, "maximum call depth", source)
+
+	e, err := Parse(`=MAKEARRAY(100; 100; LAMBDA(r; c; r * c))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (EvalOptions{MaxCalls: 50}).Evaluate(e, source); !errors.Is(err, ErrLimitExceeded) {
+		t.Fatalf("expecting limit error, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	calls := 0
+	stop := SourceMap{"STOP": func(c *Call) (interface{}, error) {
+		calls++
+		cancel()
+		return 1, nil
+	}}
+	e, err = Parse(`=MAKEARRAY(100; 100; STOP)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.EvaluateContext(ctx, Sources{source, stop}); !errors.Is(err, ErrCanceled) || calls != 1 {
+		t.Fatalf("expecting cancellation after 1 call, got %v after %d calls", err, calls)
+	}
+
+	e, err = Parse(`={1;2|3;4}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, _ := e.MarshalText(); string(text) != `={1; 2 | 3; 4}` {
+		t.Fatalf("unexpected encoding %s", text)
+	}
+	translated, err := Translate(`={1,5; 2 | 3; 4}`, ParseOptions{DecimalSeparator: ','}, ParseOptions{ArgumentSeparator: ','})
+	if err != nil || translated != `={1.5, 2; 3, 4}` {
+		t.Fatalf("unexpected translation %q (%v)", translated, err)
+	}
+}
+
+func TestLibrary(t *testing.T) {
+	var lib Library
+	err := lib.Define(`
+		DISCOUNT(price; pct) := price * (1 - pct)
+		NET(price) := DISCOUNT(price; rate) * 2
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := Sources{&lib, SourceMap{"rate": 0.25}}
+	testNumber(t, `=NET(100)`, 150, source)
+	testNumber(t, `=DISCOUNT(10; 0.5) + DISCOUNT(4; 0.5)`, 7, source)
+	testRuntimeError(t, `=DISCOUNT(10)`, "expects 2 arguments", source)
+
+	raw, err := lib.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const expected = "DISCOUNT(price; pct) := price * (1 - pct)\nNET(price) := DISCOUNT(price; rate) * 2\n"
+	if string(raw) != expected {
+		t.Fatalf("got %q, expecting %q", raw, expected)
+	}
+	var lib2 Library
+	if err := lib2.UnmarshalText(raw); err != nil {
+		t.Fatal(err)
+	}
+	testNumber(t, `=NET(100)`, 150, Sources{&lib2, SourceMap{"rate": 0.25}})
+
+	// bodies do not see the names bound by LET and LAMBDA at the call site
+	testNumber(t, `=LET(rate; 0.5; NET(100))`, 150, source)
+	testNumber(t, `=LAMBDA(rate; NET(100))(0.5)`, 150, source)
+	var lib3 Library
+	if err := lib3.Define(`TOTAL(price) := price * (1 + tax)`); err != nil {
+		t.Fatal(err)
+	}
+	testRuntimeError(t, `=LET(tax; 0.1; TOTAL(10))`, "unknown identifier tax", Sources{&lib3, Base})
+	testNumber(t, `=TOTAL(10)`, 11, Sources{&lib3, SourceMap{"tax": 0.1}})
+}
+
+func TestLibraryErrors(t *testing.T) {
+	var lib Library
+	if err := lib.Define(`A(x) := B(x) + 1`); err != nil {
+		t.Fatal(err)
+	}
+	if err := lib.Define(`B(x) := C(x)  C(x) := A(x)`); err == nil || !strings.Contains(err.Error(), "recursive definition A -> B -> C -> A") {
+		t.Fatalf("expecting recursive definition error, got %v", err)
+	}
+	if names := lib.Names(); len(names) != 1 || names[0] != "A" {
+		t.Fatalf("library modified after failed Define: %v", names)
+	}
+	if err := lib.Define(`B(x; y) := x + y`); err == nil || !strings.Contains(err.Error(), "expecting 2") {
+		t.Fatalf("expecting arity error, got %v", err)
+	}
+	if err := lib.Define(`B(x; x) := x`); err == nil {
+		t.Fatal("expecting duplicate parameter error")
+	}
+	if err := lib.Define(`B(x) = x`); err == nil {
+		t.Fatal("expecting syntax error")
+	}
+	if err := lib.Define(`B(f) := LET(A; 1; A + f(1))`); err != nil {
+		t.Fatalf("unexpected error for shadowed name: %v", err)
+	}
+}
+
+func TestEncodeParentheses(t *testing.T) {
+	tests := []struct {
+		Expr     string
+		Expected string
+	}{
+		{`=2 * (3 + 4)`, `=2 * (3 + 4)`},
+		{`=(2 * 3) + 4`, `=2 * 3 + 4`},
+		{`=(10 - 4) - 3`, `=(10 - 4) - 3`},
+		{`=10 - 4 - 3`, `=10 - 4 - 3`},
+		{`=("a" & "b") = "ab"`, `="a" & "b" = "ab"`},
+		{`=(1 = 1) = TRUE()`, `=(1 = 1) = TRUE()`},
+	}
+	for _, test := range tests {
+		e, err := Parse(test.Expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := e.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(raw) != test.Expected {
+			t.Fatalf("got %s, expecting %s", raw, test.Expected)
+		}
+	}
+	testNumber(t, `=(10 - 4) - 3`, 3, nil)
+	testBool(t, `=(1 = 2) = FALSE()`, true, nil)
+}
+
+func TestWrapFunc(t *testing.T) {
+	type label string
+	fns := SourceMap{
+		"REPEAT": WrapFunc(func(ctx context.Context, s string, n int, sep ...string) (string, error) {
+			if ctx == nil {
+				return "", errors.New("missing context")
+			}
+			if n > 3 {
+				return "", errors.New("too many")
+			}
+			joiner := ""
+			if len(sep) > 0 {
+				joiner = sep[0]
+			}
+			return strings.Repeat(s+joiner, n), nil
+		}),
+		"SCALE": WrapFunc(func(x float32, factor *uint8) int {
+			if factor == nil {
+				return int(x)
+			}
+			return int(x) * int(*factor)
+		}),
+		"LABEL": WrapFunc(func(c *Call, l label, v interface{}) label {
+			return label(c.Name) + ":" + l + ":" + label(typename(v))
+		}),
+		"APPLY": WrapFunc(func(fn Func, v interface{}) (interface{}, error) {
+			return fn(&Call{Name: "APPLY", Values: []interface{}{v}})
+		}),
+		"WIDTH": WrapFunc(func(a Array) int {
+			return a.Columns()
+		}),
+	}
+	testString(t, `=REPEAT("ab"; 2)`, "abab", fns)
+	testString(t, `=REPEAT("ab"; 2; ","; "ignored")`, "ab,ab,", fns)
+	testNumber(t, `=SCALE(2.9) + SCALE(3; 4)`, 14, fns)
+	testString(t, `=REPEAT("ab"; -0)`, "", fns)
+	testString(t, `=LABEL("x"; TRUE())`, "LABEL:x:boolean", fns)
+	testNumber(t, `=APPLY(LAMBDA(x; x * 2); 21)`, 42, fns)
+	testNumber(t, `=WIDTH({1; 2; 3})`, 3, fns)
+
+	testRuntimeError(t, `=REPEAT("ab")`, "REPEAT expects at least 2 arguments", fns)
+	testRuntimeError(t, `=REPEAT("ab"; "2")`, "REPEAT expects argument 1 to be integer", fns)
+	testRuntimeError(t, `=REPEAT("ab"; 1.5)`, "REPEAT expects argument 1 to be integer", fns)
+	testRuntimeError(t, `=REPEAT("ab"; 2^63)`, "REPEAT expects argument 1 to be integer", fns)
+	testRuntimeError(t, `=SCALE(1; -1)`, "SCALE expects argument 1 to be non-negative integer", fns)
+	testRuntimeError(t, `=SCALE(1; 256)`, "SCALE expects argument 1 to be non-negative integer", fns)
+	testRuntimeError(t, `=SCALE(1; 2.5)`, "SCALE expects argument 1 to be non-negative integer", fns)
+	testRuntimeError(t, `=SCALE(1; 2; 3)`, "SCALE expects 1 to 2 arguments", fns)
+	testRuntimeError(t, `=LABEL("x")`, "LABEL expects 2 arguments", fns)
+	testRuntimeError(t, `=WIDTH(1)`, "WIDTH expects argument 0 to be array", fns)
+
+	e, _ := Parse(`=REPEAT("ab"; 4)`)
+	if _, err := e.Evaluate(fns); err == nil || err.(*RuntimeError).Err == nil {
+		t.Fatalf("expecting wrapped error, got %v", err)
+	}
+
+	for _, fn := range []interface{}{
+		"not a function",
+		func(s []string) string { return "" },
+		func(a *string, b string) string { return "" },
+		func() {},
+		func() (string, string) { return "", "" },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("expecting WrapFunc(%T) to panic", fn)
+				}
+			}()
+			WrapFunc(fn)
+		}()
+	}
+}
+
+type testAddress struct {
+	City string
+	Zip  uint16 `exprel:"zip_code"`
+}
+
+type testAudit struct {
+	Version int8
+	Created time.Time
+}
+
+type testCustomer struct {
+	testAudit
+	Name     string
+	Age      int
+	Balance  float32
+	Secret   string `exprel:"-"`
+	Address  testAddress
+	Previous *testAddress
+	hidden   string
+}
+
+func (c testCustomer) Greeting() string {
+	return "Hello, " + c.Name
+}
+
+func (c *testCustomer) Discount(ctx context.Context, pct float64) (float64, error) {
+	if pct < 0 {
+		return 0, errors.New("negative discount")
+	}
+	return float64(c.Balance) * (1 - pct), nil
+}
+
+func TestStructSource(t *testing.T) {
+	customer := testCustomer{
+		testAudit: testAudit{
+			Version: 3,
+			Created: time.Date(2023, time.March, 15, 13, 30, 0, 0, time.UTC),
+		},
+		Name:    "Tim",
+		Age:     30,
+		Balance: 100,
+		Secret:  "shh",
+		Address: testAddress{City: "Berlin", Zip: 10115},
+		hidden:  "hidden",
+	}
+	for _, source := range []Source{StructSource(customer), StructSource(&customer)} {
+		source := Sources{Base, source}
+		testString(t, `=Name & " (" & TEXT(Age; "0") & ")"`, "Tim (30)", source)
+		testNumber(t, `=Balance + Version`, 103, source)
+		testString(t, `=Address.City & " " & TEXT(Address.zip_code; "0")`, "Berlin 10115", source)
+		testString(t, `=TEXT(Created; "yyyy-mm-dd hh:mm")`, "2023-03-15 13:30", source)
+		testString(t, `=Greeting`, "Hello, Tim", source)
+		testNumber(t, `=Discount(0.25)`, 75, source)
+		testRuntimeError(t, `=Secret`, "unknown identifier", source)
+		testRuntimeError(t, `=hidden`, "unknown identifier", source)
+		testRuntimeError(t, `=Previous.City`, "unknown identifier", source)
+		testRuntimeError(t, `=Address.Country`, "unknown identifier", source)
+		testRuntimeError(t, `=Name.First`, "unknown identifier", source)
+	}
+	e, _ := Parse(`=Discount(-1)`)
+	if _, err := e.Evaluate(StructSource(&customer)); err == nil || err.(*RuntimeError).Err == nil {
+		t.Fatalf("expecting wrapped error, got %v", err)
+	}
+
+	for _, v := range []interface{}{nil, (*testCustomer)(nil), 1, &[]int{}} {
+		func() {
+			defer func() {
+				if rec, _ := recover().(string); !strings.HasPrefix(rec, "exprel: StructSource expects struct") {
+					t.Fatalf("expecting StructSource(%T) to panic, got %v", v, rec)
+				}
+			}()
+			StructSource(v)
+		}()
+	}
+}
+
+type testLevel string
+
+type testColor int
+
+func (c testColor) String() string {
+	return [...]string{"red", "green"}[c]
+}
+
+type testPoint struct {
+	X, Y int
+}
+
+func (p testPoint) String() string {
+	return fmt.Sprintf("(%d, %d)", p.X, p.Y)
+}
+
+func TestNormalize(t *testing.T) {
+	source := SourceMap{
+		"i":      42,
+		"u8":     uint8(7),
+		"f32":    float32(0.5),
+		"level":  testLevel("high"),
+		"num":    json.Number("1.25"),
+		"ptr":    &[]int{1}[0],
+		"slice":  []int{1, 2},
+		"color":  testColor(1),
+		"point":  testPoint{1, 2},
+		"INT":    func(*Call) (interface{}, error) { return 3, nil },
+		"points": []testPoint{{1, 2}},
+		"SLICE":  func(*Call) (interface{}, error) { return [][]interface{}{{testPoint{}}}, nil },
+		"LEVEL":  func(*Call) (interface{}, error) { return testLevel("low"), nil },
+		"NUMBER": WrapFunc(func() json.Number { return "10" }),
+	}
+	testNumber(t, `=i + u8 + f32 + num + ptr`, 51.75, source)
+	testString(t, `=level & LEVEL()`, "highlow", source)
+	testNumber(t, `=INT() * NUMBER()`, 30, source)
+	testRuntimeError(t, `=points`, `identifier 'points' has invalid type: unsupported type exprel.testPoint`, source)
+	testRuntimeError(t, `=SLICE()`, `SLICE returned unsupported type exprel.testPoint`, source)
+	testRuntimeError(t, `=point`, `unsupported type exprel.testPoint`, source)
+	testNumber(t, `=color`, 1, source)
+	testString(t, `=color & " " & point`, "green (1, 2)", StringerSource(source))
+	testNumber(t, `=i`, 42, StringerSource(source))
+
+	if _, err := Normalize(json.Number("abc")); err == nil {
+		t.Fatal("expecting invalid json.Number error")
+	}
+	if _, err := Normalize(nil); err == nil {
+		t.Fatal("expecting nil error")
+	}
+}
+
+func TestJSONSource(t *testing.T) {
+	const doc = `{
+		"id": 12345678901234567,
+		"name": "Tim",
+		"active": true,
+		"missing": null,
+		"address": {"city": "Berlin", "zip": "10115"},
+		"items": [{"price": 2.5}, {"price": 4}],
+		"first-name": "T"
+	}`
+	for _, source := range []Source{JSONSource([]byte(doc)), JSONSourceReader(strings.NewReader(doc))} {
+		source := Sources{Base, source}
+		testString(t, `=IF(active; name & " from " & address.city; "")`, "Tim from Berlin", source)
+		testNumber(t, `=items.0.price + items.1.price`, 6.5, source)
+		testNumber(t, `=id`, 12345678901234567, source)
+		testString(t, `=LET(a; address; a.zip)`, "10115", source)
+		testNumber(t, `=TYPE(address) + TYPE(items)`, 320, source)
+		testNumber(t, `=REDUCE(0; items; LAMBDA(sum; item; sum + item.price))`, 6.5, source)
+		testNumber(t, `=JSONPATH(items; "$[1].price")`, 4, source)
+		testRuntimeError(t, `=items.2.price`, "unknown identifier", source)
+		testRuntimeError(t, `=missing`, "unsupported nil value", source)
+
+		value, err := Evaluate(`=address`, source)
+		if err != nil || !reflect.DeepEqual(value, Record{"city": "Berlin", "zip": "10115"}) {
+			t.Fatalf("unexpected address %v (%v)", value, err)
+		}
+		value, err = Evaluate(`=MAP(items; LAMBDA(item; item.price * 2))`, source)
+		if err != nil || !reflect.DeepEqual(value, Array{{5.0}, {8.0}}) {
+			t.Fatalf("unexpected prices %v (%v)", value, err)
+		}
+	}
+	testNumber(t, `=ROWS(a) * 10 + COLUMNS(a)`, 22, Sources{Base, JSONSource([]byte(`{"a": [[1, 2], [3, 4]]}`))})
+	testString(t, `=JSONPATH(a; "$[1][0]")`, "c", Sources{Base, JSONSource([]byte(`{"a": [["a", "b"], ["c", "d"]]}`))})
+	testRuntimeError(t, `=a`, "unsupported nil value", JSONSource([]byte(`{"a": [1, null]}`)))
+	testRuntimeError(t, `=a`, "", JSONSource([]byte(`[1, 2]`)))
+	testRuntimeError(t, `=a`, "", JSONSource([]byte(`{"a": 1`)))
+}
+
+func TestRecords(t *testing.T) {
+	source := Sources{Base, SourceMap{
+		"order": map[string]interface{}{
+			"total":    5,
+			"customer": map[string]string{"name": "Tim"},
+			"DOUBLE":   func(c *Call) (interface{}, error) { return c.Number(0) * 2, nil },
+		},
+		"order.total": 7,
+	}}
+	testNumber(t, `=order.total`, 7, source)
+	testString(t, `=order.customer.name`, "Tim", source)
+	testNumber(t, `=order.DOUBLE(4)`, 8, source)
+	testNumber(t, `=LET(o; order; o.total)`, 5, source)
+	testString(t, `=LAMBDA(o; o.customer.name)(order)`, "Tim", source)
+	testNumber(t, `=TYPE(order)`, 256, source)
+	testRuntimeError(t, `=order.missing`, "unknown identifier order.missing", source)
+	testRuntimeError(t, `=LET(o; 1; o.total)`, "unknown identifier o.total", source)
+
+	e, err := ParseOptions{CaseInsensitive: true}.Parse(`=LET(Order; order; ORDER.total + order.total)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := e.Evaluate(source); err != nil || value != 10.0 {
+		t.Fatalf("expecting 10, got %v (%v)", value, err)
+	}
+	e, err = Parse(`=LET(o; order; o.total + o.DOUBLE(1) + total)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := e.Identifiers(); !reflect.DeepEqual(ids, []string{"order", "total"}) {
+		t.Fatalf("unexpected identifiers %v", ids)
+	}
+
+	var lib Library
+	if err := lib.Define(`TOTAL(order) := order.total * 2`); err != nil {
+		t.Fatal(err)
+	}
+	testNumber(t, `=TOTAL(order)`, 10, Sources{&lib, source})
+}
+
+func TestBaseJSONPATH(t *testing.T) {
+	source := Sources{Base, SourceMap{
+		"doc": `{"a": {"b": [10, {"c d": "x"}]}, "n": null}`,
+	}}
+	testNumber(t, `=JSONPATH(doc; "$.a.b[0]")`, 10, source)
+	testString(t, `=JSONPATH(doc; "$.a.b[1]['c d']")`, "x", source)
+	testString(t, `=JSONPATH(JSONPATH(doc; "$.a.b[-1]"); "$['c d']")`, "x", source)
+	testNumber(t, `=ROWS(JSONPATH(doc; "$.a.b"))`, 2, source)
+	value, err := Evaluate(`=JSONPATH(doc; "$")`, source)
+	if err != nil || !reflect.DeepEqual(value, Record{"a": Record{"b": Array{{10.0}, {Record{"c d": "x"}}}}}) {
+		t.Fatalf("unexpected document %v (%v)", value, err)
+	}
+	testRuntimeError(t, `=JSONPATH(1; "$")`, "string, record or array", source)
+	testRuntimeError(t, `=JSONPATH(doc; "$.a.c")`, "not found", source)
+	testRuntimeError(t, `=JSONPATH(doc; "$.n")`, "null", source)
+	testRuntimeError(t, `=JSONPATH(doc; "a.b")`, "invalid path", source)
+	testRuntimeError(t, `=JSONPATH(doc; "$.a[x]")`, "invalid index", source)
+	testRuntimeError(t, `=JSONPATH("{"; "$")`, "invalid document", source)
+}
+
+func TestCachedSource(t *testing.T) {
+	var fetches int32
+	backing := SourceFunc(func(ctx context.Context, name string) (interface{}, bool) {
+		atomic.AddInt32(&fetches, 1)
+		if name == "x" {
+			return float64(3), true
+		}
+		return nil, false
+	})
+
+	cached := CachedSource(backing)
+	testNumber(t, `=IF(x > 1; x * 2; x)`, 6, cached)
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		// testNumber evaluates the expression twice
+		t.Fatalf("got %d fetches, expecting 2", n)
+	}
+	testRuntimeError(t, `=y + y`, "unknown identifier y", cached)
+	if stats := cached.Stats(); stats != (CacheStats{Hits: 2, Misses: 3}) {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	atomic.StoreInt32(&fetches, 0)
+	cached = CachedSourceTTL(backing, time.Hour)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := EvaluateContext(context.Background(), `=x + x`, cached); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	testNumber(t, `=x * x`, 9, cached)
+	if n := atomic.LoadInt32(&fetches); n < 1 || n > 8 {
+		t.Fatalf("got %d fetches, expecting at most 8", n)
+	}
+	atomic.StoreInt32(&fetches, 0)
+	testNumber(t, `=x`, 3, cached)
+	if n := atomic.LoadInt32(&fetches); n != 0 {
+		t.Fatalf("got %d fetches, expecting 0", n)
+	}
+	cached.Purge()
+	testNumber(t, `=x`, 3, cached)
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Fatalf("got %d fetches after Purge, expecting 1", n)
+	}
+}
+
+type testBatchSource struct {
+	SourceMap
+	Batches [][]string
+	Gets    int
+}
+
+func (s *testBatchSource) Get(ctx context.Context, name string) (interface{}, bool) {
+	s.Gets++
+	return s.SourceMap.Get(ctx, name)
+}
+
+func (s *testBatchSource) GetMany(ctx context.Context, names []string) (map[string]interface{}, error) {
+	s.Batches = append(s.Batches, names)
+	if len(names) > 0 && names[0] == "fail" {
+		return nil, errors.New("backend unavailable")
+	}
+	values := make(map[string]interface{})
+	for _, name := range names {
+		if value, ok := s.SourceMap[name]; ok {
+			values[name] = value
+		}
+	}
+	return values, nil
+}
+
+func TestEvaluatePrefetch(t *testing.T) {
+	e, err := Parse(`=LET(z; a + b; IF(z > 2; UPPER(name) & TEXT(z; "0"); name & c)) & LAMBDA(a; a)(d)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := e.Identifiers(); !reflect.DeepEqual(ids, []string{"a", "b", "name", "c", "d"}) {
+		t.Fatalf("unexpected identifiers %v", ids)
+	}
+
+	db := &testBatchSource{
+		SourceMap: SourceMap{"a": 1, "b": 2, "name": "tim", "d": "!"},
+	}
+	source := Sources{Base, db}
+	val, err := String(e.EvaluatePrefetch(context.Background(), source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "TIM3!" {
+		t.Fatalf("got %s, expecting TIM3!", val)
+	}
+	if !reflect.DeepEqual(db.Batches, [][]string{{"a", "b", "name", "c", "d"}}) || db.Gets != 0 {
+		t.Fatalf("unexpected lookups: batches %v, gets %d", db.Batches, db.Gets)
+	}
+
+	e, _ = Parse(`=fail`)
+	if _, err := e.EvaluatePrefetch(context.Background(), db); err == nil || err.(*RuntimeError).Err == nil {
+		t.Fatalf("expecting GetMany error, got %v", err)
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	opts := ParseOptions{CaseInsensitive: true}
+	source := Sources{Base, SourceMap{"Name": "tim", "x": 2}}
+	tests := []struct {
+		Expr     string
+		Expected string
+	}{
+		{`=if(and(true(); not(False())); upper(Name); "")`, `=IF(AND(TRUE(); NOT(FALSE())); UPPER(Name); "")`},
+		{`=Let(F; Lambda(V; v * 2); f(x) + 1)`, `=LET(F; LAMBDA(V; V * 2); F(x) + 1)`},
+		{`=Len(Name)`, `=LEN(Name)`},
+	}
+	for _, test := range tests {
+		e, err := opts.Parse(test.Expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := e.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(raw) != test.Expected {
+			t.Fatalf("got %s, expecting %s", raw, test.Expected)
+		}
+		if _, err := e.Evaluate(source); err != nil {
+			t.Fatalf("%s: %s", test.Expr, err)
+		}
+	}
+
+	if _, err := Parse(`=if(true(); 1; 2)`); err != nil {
+		t.Fatal(err)
+	}
+	testRuntimeError(t, `=if(TRUE(); 1; 2)`, "unknown function if", source)
+}
+
+func TestCaseFoldSource(t *testing.T) {
+	backing := SourceFunc(func(ctx context.Context, name string) (interface{}, bool) {
+		if name == "TOTAL" {
+			return float64(10), true
+		}
+		return nil, false
+	})
+	source := CaseFoldSource(Sources{Base, SourceMap{"userName": "Tim", "username": "other"}, backing})
+	testString(t, `=UPPER(USERNAME) & username & Username`, "TIMotherTim", source)
+	testNumber(t, `=total + Total`, 20, source)
+	testRuntimeError(t, `=missing`, "unknown identifier", source)
+	testString(t, `=lower("A")`, "a", source)
+}
+
 func TestBaseCHOOSE(t *testing.T) {
 	expr := `=CHOOSE(1; 10; 20; 30)`
 	testNumber(t, expr, 20, Base)
@@ -178,6 +931,9 @@ func TestBaseTYPE(t *testing.T) {
 
 	expr = `=TYPE(TRUE())`
 	testNumber(t, expr, 4, Base)
+
+	expr = `=TYPE({1; 2})`
+	testNumber(t, expr, 64, Base)
 }
 
 func TestBaseABS(t *testing.T) {
@@ -306,8 +1062,1092 @@ func TestBaseUPPER(t *testing.T) {
 	testString(t, expr, "HEYTHERE", Base)
 }
 
+func TestBaseDOLLAR(t *testing.T) {
+	expr := `=DOLLAR(1234.567)`
+	testString(t, expr, "$1,234.57", Base)
+
+	expr = `=DOLLAR(-1234.567; 0)`
+	testString(t, expr, "($1,235)", Base)
+
+	expr = `=DOLLAR(1; -400)`
+	testRuntimeError(t, expr, "DOLLAR decimals out of range", Base)
+}
+
+func TestBaseFIXED(t *testing.T) {
+	expr := `=FIXED(1234567.891)`
+	testString(t, expr, "1,234,567.89", Base)
+
+	expr = `=FIXED(1234.5; -2; TRUE())`
+	testString(t, expr, "1200", Base)
+
+	expr = `=FIXED(-0.5; 0)`
+	testString(t, expr, "-1", Base)
+
+	expr = `=LEN(FIXED(2; 308; TRUE()))`
+	testNumber(t, expr, 310, Base)
+
+	expr = `=FIXED(1; 400)`
+	testRuntimeError(t, expr, "FIXED decimals out of range", Base)
+}
+
+func TestBaseN(t *testing.T) {
+	expr := `=N(12) + N(TRUE()) + N("34")`
+	testNumber(t, expr, 13, Base)
+}
+
+func TestBaseNUMBERVALUE(t *testing.T) {
+	expr := `=NUMBERVALUE("1.234,5"; ","; ".")`
+	testNumber(t, expr, 1234.5, Base)
+
+	expr = `=NUMBERVALUE(" 2 500 % "; "."; " ")`
+	testNumber(t, expr, 25, Base)
+
+	expr = `=NUMBERVALUE("1.5"; ","; ".")`
+	testNumber(t, expr, 15, Base)
+
+	expr = `=NUMBERVALUE("abc")`
+	testRuntimeError(t, expr, "cannot convert", Base)
+}
+
+func TestBaseT(t *testing.T) {
+	expr := `=T("a") & T(1) & T(TRUE())`
+	testString(t, expr, "a", Base)
+}
+
+func TestBaseTEXT(t *testing.T) {
+	tests := []struct {
+		Expr     string
+		Expected string
+	}{
+		{`=TEXT(0.125; "0.0%")`, "12.5%"},
+		{`=TEXT(1234.567; "#,##0.00")`, "1,234.57"},
+		{`=TEXT(1234567; "#,##0")`, "1,234,567"},
+		{`=TEXT(3.5; "0.00")`, "3.50"},
+		{`=TEXT(-3.5; "0.00")`, "-3.50"},
+		{`=TEXT(-3.5; "0.00;(0.00)")`, "(3.50)"},
+		{`=TEXT(0; "0;-0;\"zero\"")`, "zero"},
+		{`=TEXT(0.5; "#.##")`, ".5"},
+		{`=TEXT(7; "000")`, "007"},
+		{`=TEXT(1234567; "0.0,,\"M\"")`, "1.2M"},
+		{`=TEXT(42; "\"$\"0")`, "$42"},
+		{`=TEXT("42"; "0.0")`, "42.0"},
+		{`=TEXT("abc"; "0.0")`, "abc"},
+		{`=TEXT("abc"; "0;0;0;\"<\"@\">\"")`, "<abc>"},
+		{`=TEXT(45000; "yyyy-mm-dd")`, "2023-03-15"},
+		{`=TEXT(45000.5625; "dddd, mmmm d, yyyy h:mm AM/PM")`, "Wednesday, March 15, 2023 1:30 PM"},
+		{`=TEXT(45000.5625; "hh:mm:ss")`, "13:30:00"},
+		{`=TEXT(1.5; "[h]:mm")`, "36:00"},
+		{`=TEXT(1.5; "General")`, "1.5"},
+		{`=TEXT(10^7; "[h]")`, "240000000"},
+		{`=TEXT(-693593; "yyyy-mm-dd")`, "0001-01-01"},
+		{`=TEXT(2958465.5; "yyyy-mm-dd hh:mm")`, "9999-12-31 12:00"},
+	}
+	for _, test := range tests {
+		testString(t, test.Expr, test.Expected, Base)
+	}
+
+	for _, expr := range []string{`=TEXT(10^300; "[h]")`, `=TEXT(10^300; "yyyy")`, `=TEXT(2958466; "yyyy")`, `=TEXT(-10^7; "[h]:mm")`} {
+		testRuntimeError(t, expr, "TEXT date out of range", Base)
+	}
+}
+
+func TestBaseVALUE(t *testing.T) {
+	expr := `=VALUE("42")`
+	testNumber(t, expr, 42, Base)
+
+	expr = `=VALUE(" $1,234.50 ")`
+	testNumber(t, expr, 1234.5, Base)
+
+	expr = `=VALUE("12.5%")`
+	testNumber(t, expr, 0.125, Base)
+
+	expr = `=VALUE("(3)")`
+	testNumber(t, expr, -3, Base)
+
+	expr = `=VALUE(7)`
+	testNumber(t, expr, 7, Base)
+
+	expr = `=VALUE("12abc")`
+	testRuntimeError(t, expr, "cannot convert", Base)
+}
+
 // testing helpers
 
+func TestSeparators(t *testing.T) {
+	english := ParseOptions{ArgumentSeparator: ','}
+	german := ParseOptions{DecimalSeparator: ','}
+	tests := []struct {
+		Opts     ParseOptions
+		Expr     string
+		Expected float64
+	}{
+		{english, `=IF(TRUE(), 1.5, 2)`, 1.5},
+		{english, `=CHOOSE(1, 1, 2.25, 3) * 2`, 4.5},
+		{german, `=IF(TRUE(); 1,5; 2)`, 1.5},
+		{german, `=CHOOSE(1; 1; 2,25; 3) * 2`, 4.5},
+		{english, `=INDEX({1, 2.5; 3, 4}, 1, 2)`, 2.5},
+		{german, `=INDEX({1; 2,5 | 3; 4}; 1; 2)`, 2.5},
+		{ParseOptions{ArrayColumnSeparator: '\\'}, `=INDEX({1 \ 2; 3 \ 4}; 2; 1)`, 3},
+		{ParseOptions{ArgumentSeparator: ',', ArrayColumnSeparator: ';', ArrayRowSeparator: ','}, `=INDEX({1; 2, 3; 4}, 2, 1)`, 3},
+	}
+	for _, test := range tests {
+		e, err := test.Opts.Parse(test.Expr)
+		if err != nil {
+			t.Fatalf("%s: %s", test.Expr, err)
+		}
+		value, err := e.Evaluate(Base)
+		if err != nil {
+			t.Fatalf("%s: %s", test.Expr, err)
+		}
+		if value != test.Expected {
+			t.Fatalf("%s: got %v, expecting %v", test.Expr, value, test.Expected)
+		}
+	}
+
+	if _, err := english.Parse(`=IF(TRUE(); 1; 2)`); err == nil {
+		t.Fatal("expected syntax error for ';' with ',' separator")
+	}
+	invalid := []ParseOptions{
+		{ArgumentSeparator: '|'},
+		{DecimalSeparator: ';'},
+		{ArgumentSeparator: ',', DecimalSeparator: ','},
+		{ArrayColumnSeparator: '.'},
+		{ArrayColumnSeparator: '|', ArrayRowSeparator: '|'},
+		{ArrayRowSeparator: ';'},
+		{DecimalSeparator: ',', ArrayColumnSeparator: ','},
+	}
+	for _, opts := range invalid {
+		if _, err := opts.Parse(`=1`); err == nil {
+			t.Fatalf("expected error for %+v", opts)
+		}
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	english := ParseOptions{ArgumentSeparator: ','}
+	german := ParseOptions{DecimalSeparator: ','}
+	tests := []struct {
+		From, To ParseOptions
+		Expr     string
+		Expected string
+	}{
+		{english, german, `=IF(a > 1.5, ROUND(a, 2), "1,5")`, `=IF(a > 1,5; ROUND(a; 2); "1,5")`},
+		{german, english, `=IF(a > 1,5; ROUND(a; 2); "1,5")`, `=IF(a > 1.5, ROUND(a, 2), "1,5")`},
+		{english, ParseOptions{}, `=LET(x, 0.5, x * 2)`, `=LET(x; 0.5; x * 2)`},
+		{english, german, `1.5, not an expression`, `1.5, not an expression`},
+		{english, german, `=ROWS({1.5, 2; 3, 4})`, `=ROWS({1,5; 2 | 3; 4})`},
+		{german, english, `=ROWS({1,5; 2 | 3; 4})`, `=ROWS({1.5, 2; 3, 4})`},
+		{ParseOptions{}, ParseOptions{ArrayColumnSeparator: '\\', ArrayRowSeparator: ';'}, `={1; 2 | 3; 4}`, `={1 \ 2; 3 \ 4}`},
+	}
+	for _, test := range tests {
+		translated, err := Translate(test.Expr, test.From, test.To)
+		if err != nil {
+			t.Fatalf("%s: %s", test.Expr, err)
+		}
+		if translated != test.Expected {
+			t.Fatalf("got %s, expecting %s", translated, test.Expected)
+		}
+	}
+}
+
+func TestLocale(t *testing.T) {
+	source := Sources{Base, SourceMap{"name": "Tim", "E": 2.0}}
+	tests := []struct {
+		Opts      ParseOptions
+		Expr      string
+		Canonical string
+		Expected  interface{}
+	}{
+		{
+			ParseOptions{Locale: LocaleDE, DecimalSeparator: ','},
+			`=WENN(UND(WAHR(); LÄNGE(name) > 2); GROSS(name); LINKS(name))`,
+			`=IF(AND(TRUE(); LEN(name) > 2); UPPER(name); LEFT(name))`,
+			"TIM",
+		},
+		{
+			ParseOptions{Locale: LocaleFR, CaseInsensitive: true},
+			`=si(non(faux()); gauche(name; 2) & minuscule(name); "")`,
+			`=IF(NOT(FALSE()); LEFT(name; 2) & LOWER(name); "")`,
+			"Titim",
+		},
+		{
+			ParseOptions{Locale: LocaleES},
+			`=SI.CONJUNTO(LARGO(name) = 1; "a"; Y(VERDADERO(); E > 1); DERECHA(name))`,
+			`=IFS(LEN(name) = 1; "a"; AND(TRUE(); E > 1); RIGHT(name))`,
+			"m",
+		},
+		{
+			ParseOptions{Locale: LocalePT},
+			`=SE(E(E > 1); NÚM.CARACT(name); 0)`,
+			`=IF(AND(E > 1); LEN(name); 0)`,
+			float64(3),
+		},
+		{
+			ParseOptions{Locale: LocaleFR},
+			`=LET(SI; LAMBDA(x; x * 2); SI(E))`,
+			`=LET(SI; LAMBDA(x; x * 2); SI(E))`,
+			float64(4),
+		},
+	}
+	for _, test := range tests {
+		e, err := test.Opts.Parse(test.Expr)
+		if err != nil {
+			t.Fatalf("%s: %s", test.Expr, err)
+		}
+		raw, err := e.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(raw) != test.Canonical {
+			t.Fatalf("got %s, expecting %s", raw, test.Canonical)
+		}
+		value, err := e.Evaluate(source)
+		if err != nil {
+			t.Fatalf("%s: %s", test.Expr, err)
+		}
+		if value != test.Expected {
+			t.Fatalf("%s: got %v, expecting %v", test.Expr, value, test.Expected)
+		}
+	}
+
+	german := ParseOptions{Locale: LocaleDE, DecimalSeparator: ','}
+	translated, err := Translate(`=IF(LEN(name) > 2.5; UPPER(name); ABS(-1))`, ParseOptions{}, german)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const expected = `=WENN(LÄNGE(name) > 2,5; GROSS(name); ABS(-1))`
+	if translated != expected {
+		t.Fatalf("got %s, expecting %s", translated, expected)
+	}
+}
+
+func TestRuntimeErrorLocation(t *testing.T) {
+	var lib Library
+	if err := lib.Define(`HALF(x) := x / 2` + "\n" + `TWICE(x) := HALF(x) * 4`); err != nil {
+		t.Fatal(err)
+	}
+	source := Sources{Base, &lib, SourceMap{"a": 1.0, "b": "x"}}
+	tests := []struct {
+		Expr     string
+		Excerpt  string
+		Function string
+		Calls    []string
+	}{
+		{
+			`=IF(a > 0; a = b; FALSE())`,
+			"=IF(a > 0; a = b; FALSE())\n           ^^^^^",
+			"",
+			nil,
+		},
+		{
+			`=IF(c; 1; 2)`,
+			"=IF(c; 1; 2)\n    ^",
+			"",
+			nil,
+		},
+		{
+			`=1 + LEN(LEFT(b; "2"))`,
+			"=1 + LEN(LEFT(b; \"2\"))\n         ^^^^^^^^^^^^",
+			"LEFT",
+			[]string{"LEFT"},
+		},
+		{
+			`=LET(f; LAMBDA(x; x & "!"); f(1))`,
+			"=LET(f; LAMBDA(x; x & \"!\"); f(1))\n                  ^^^^^^^",
+			"f",
+			[]string{"f"},
+		},
+		{
+			"=1 +\n\tTWICE(b)",
+			"\tTWICE(b)\n\t^^^^^^^^",
+			"HALF",
+			[]string{"TWICE", "HALF"},
+		},
+		{
+			`=AND(TRUE(); 1)`,
+			"=AND(TRUE(); 1)\n ^^^^^^^^^^^^^^",
+			"AND",
+			nil,
+		},
+	}
+	for _, test := range tests {
+		_, err := Evaluate(test.Expr, source)
+		runtimeErr, ok := err.(*RuntimeError)
+		if !ok {
+			t.Fatalf("%s: expecting *RuntimeError, got %v", test.Expr, err)
+		}
+		if excerpt := runtimeErr.Excerpt(test.Expr); excerpt != test.Excerpt {
+			t.Fatalf("%s: got excerpt\n%s\nexpecting\n%s", test.Expr, excerpt, test.Excerpt)
+		}
+		if runtimeErr.Function != test.Function {
+			t.Fatalf("%s: got function %q, expecting %q", test.Expr, runtimeErr.Function, test.Function)
+		}
+		if !reflect.DeepEqual(runtimeErr.Calls, test.Calls) {
+			t.Fatalf("%s: got calls %v, expecting %v", test.Expr, runtimeErr.Calls, test.Calls)
+		}
+	}
+}
+
+func TestSyntaxErrorPosition(t *testing.T) {
+	tests := []struct {
+		Expr     string
+		Line     int
+		Column   int
+		Expected []string
+		Message  string
+	}{
+		{`=5 + $`, 1, 6, nil, "unexpected character '$'"},
+		{`=5 6`, 1, 4, []string{"EOF"}, "unexpected number 6, expecting EOF"},
+		{`=IF(1;2`, 1, 8, []string{"';'"}, "unexpected EOF, expecting ';'"},
+		{`=AND(TRUE() FALSE())`, 1, 13, []string{"';'", "')'"}, "unexpected identifier FALSE, expecting ';' or ')'"},
+		{"=IF(a;\n  b;\n  LEFT(\"é\" 1))", 3, 12, []string{"';'", "')'"}, "unexpected number 1, expecting ';' or ')'"},
+		{`=LAMBDA(x; 1; x)`, 1, 12, nil, "LAMBDA expects identifier"},
+		{`=1 + )`, 1, 6, []string{"expression"}, "unexpected ')', expecting expression"},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.Expr)
+		syntaxErr, ok := err.(*SyntaxError)
+		if !ok {
+			t.Fatalf("%s: expecting *SyntaxError, got %v", test.Expr, err)
+		}
+		if syntaxErr.Line != test.Line || syntaxErr.Column != test.Column {
+			t.Fatalf("%s: got %d:%d, expecting %d:%d", test.Expr, syntaxErr.Line, syntaxErr.Column, test.Line, test.Column)
+		}
+		if !reflect.DeepEqual(syntaxErr.Expected, test.Expected) {
+			t.Fatalf("%s: got expected %v, expecting %v", test.Expr, syntaxErr.Expected, test.Expected)
+		}
+		if syntaxErr.Message != test.Message {
+			t.Fatalf("%s: got message %q, expecting %q", test.Expr, syntaxErr.Message, test.Message)
+		}
+	}
+
+	_, err := ParseOptions{ArgumentSeparator: ','}.Parse(`=MAX(1, 2 3)`)
+	const expected = "exprel: syntax error at line 1, column 11: unexpected number 3, expecting ',' or ')'\n" +
+		"=MAX(1, 2 3)\n" +
+		"          ^"
+	if report := err.(*SyntaxError).Format(`=MAX(1, 2 3)`); report != expected {
+		t.Fatalf("got report\n%s\nexpecting\n%s", report, expected)
+	}
+}
+
+func TestParseRecover(t *testing.T) {
+	tests := []struct {
+		Expr    string
+		Columns []int
+	}{
+		{`=1 + 2`, nil},
+		{`=IF(1 2; 3; 4)`, []int{7}},
+		{`=LEN(IF(1; 2)) + $ + 3`, []int{13, 18}},
+		{`=AND(TRUE() FALSE(); $; NOT(1 +))`, []int{13, 22, 32}},
+		{`=LET(1; 2; x; 3; x)`, []int{6}},
+		{`=IF(1;2`, []int{8}},
+		{`=(1 + )) + 2`, []int{7, 8}},
+	}
+	for _, test := range tests {
+		e, errs, err := ParseOptions{}.ParseRecover(test.Expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var columns []int
+		for _, syntaxErr := range errs {
+			columns = append(columns, syntaxErr.Column)
+		}
+		if !reflect.DeepEqual(columns, test.Columns) {
+			t.Fatalf("%s: got errors at columns %v (%v), expecting %v", test.Expr, columns, errs, test.Columns)
+		}
+		raw, err := e.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(raw) != test.Expr {
+			t.Fatalf("got %s, expecting %s", raw, test.Expr)
+		}
+		if _, err := Parse(test.Expr); (err == nil) != (len(errs) == 0) {
+			t.Fatalf("%s: Parse returned %v", test.Expr, err)
+		}
+	}
+
+	e, errs, err := ParseOptions{}.ParseRecover(`=IF(TRUE(); "ok"; 1 +)`)
+	if err != nil || len(errs) != 1 {
+		t.Fatalf("unexpected result %v %v", errs, err)
+	}
+	if value, err := String(e.Evaluate(nil)); err != nil || value != "ok" {
+		t.Fatalf("got %v %v, expecting ok", value, err)
+	}
+	e, _, _ = ParseOptions{}.ParseRecover(`=IF(FALSE(); "ok"; 1 +)`)
+	if _, err := e.Evaluate(nil); err == nil || !strings.Contains(err.Error(), "invalid expression") {
+		t.Fatalf("expecting invalid expression error, got %v", err)
+	}
+
+	// the policy is checked against the parts that could be parsed
+	opts := ParseOptions{Policy: &Policy{DenyFunctions: []string{"RAND"}}}
+	e, errs, err = opts.ParseRecover(`=IF(RAND(); 1; $)`)
+	var policyErr *PolicyError
+	if e == nil || len(errs) != 1 || !errors.As(err, &policyErr) || policyErr.Name != "RAND" || policyErr.Span != (Span{4, 10}) {
+		t.Fatalf("expecting policy error for RAND, got %v %v %#v", e, errs, err)
+	}
+	if _, errs, err = opts.ParseRecover(`=ABS(1 +)`); len(errs) != 1 || err != nil {
+		t.Fatalf("unexpected result %v %v", errs, err)
+	}
+}
+
+func TestSuggestions(t *testing.T) {
+	source := Sources{Base, SourceMap{"Total": 1.0, "Subtotal": 2.0, "tax_rate": 0.1}}
+	tests := []struct {
+		Expr        string
+		Suggestions []string
+		Message     string
+	}{
+		{`=total`, []string{"Total"}, "unknown identifier total (did you mean Total?)"},
+		{`=tax_rat * 2`, []string{"tax_rate"}, "unknown identifier tax_rat (did you mean tax_rate?)"},
+		{`=LENN("a")`, []string{"LEN"}, "unknown function LENN (did you mean LEN?)"},
+		{`=lower("A")`, []string{"LOWER"}, "unknown function lower (did you mean LOWER?)"},
+		{`=LET(amount; 1; amout + 1)`, []string{"amount"}, "unknown identifier amout (did you mean amount?)"},
+		{`=xyzzy`, nil, "unknown identifier xyzzy"},
+	}
+	for _, test := range tests {
+		_, err := Evaluate(test.Expr, source)
+		runtimeErr, ok := err.(*RuntimeError)
+		if !ok {
+			t.Fatalf("%s: expecting *RuntimeError, got %v", test.Expr, err)
+		}
+		if !reflect.DeepEqual(runtimeErr.Suggestions, test.Suggestions) {
+			t.Fatalf("%s: got suggestions %v, expecting %v", test.Expr, runtimeErr.Suggestions, test.Suggestions)
+		}
+		if runtimeErr.Message != test.Message {
+			t.Fatalf("%s: got message %q, expecting %q", test.Expr, runtimeErr.Message, test.Message)
+		}
+	}
+
+	// sources that cannot be enumerated give no suggestions
+	fn := SourceFunc(func(ctx context.Context, name string) (interface{}, bool) {
+		return nil, false
+	})
+	_, err := Evaluate(`=Totl`, Sources{fn, SourceMap{"Total": 1.0}})
+	if suggestions := err.(*RuntimeError).Suggestions; !reflect.DeepEqual(suggestions, []string{"Total"}) {
+		t.Fatalf("got suggestions %v", suggestions)
+	}
+	_, err = Evaluate(`=Totl`, fn)
+	if suggestions := err.(*RuntimeError).Suggestions; suggestions != nil {
+		t.Fatalf("got suggestions %v", suggestions)
+	}
+}
+
+func TestErrorKinds(t *testing.T) {
+	funcErr := errors.New("failed")
+	source := Sources{Base, SourceMap{
+		"a": 1.0,
+		"FAIL": func(*Call) (interface{}, error) {
+			return nil, funcErr
+		},
+		"bad": struct{}{},
+	}}
+	tests := []struct {
+		Expr string
+		Kind *ErrorKind
+		Code string
+	}{
+		{`=a / 0`, ErrDivisionByZero, "DIVISION_BY_ZERO"},
+		{`=b`, ErrUnknownIdentifier, "UNKNOWN_IDENTIFIER"},
+		{`=B()`, ErrUnknownFunction, "UNKNOWN_FUNCTION"},
+		{`=a & "x"`, ErrTypeMismatch, "TYPE_MISMATCH"},
+		{`=LEN(a)`, ErrTypeMismatch, "TYPE_MISMATCH"},
+		{`=bad`, ErrTypeMismatch, "TYPE_MISMATCH"},
+		{`=TYPE()`, ErrArgumentCount, "ARGUMENT_COUNT"},
+		{`=LAMBDA(x; x)()`, ErrArgumentCount, "ARGUMENT_COUNT"},
+		{`=VALUE("abc")`, ErrInvalidArgument, "INVALID_ARGUMENT"},
+		{`=SWITCH(a; 2; 3)`, ErrNoMatch, "NO_MATCH"},
+		{`=LET(f; LAMBDA(f; f(f)); f(f))`, ErrLimitExceeded, "LIMIT_EXCEEDED"},
+		{`=FAIL()`, ErrFunction, "FUNCTION"},
+	}
+	for _, test := range tests {
+		_, err := Evaluate(test.Expr, source)
+		if !errors.Is(err, test.Kind) {
+			t.Fatalf("%s: expecting %s, got %v", test.Expr, test.Code, err)
+		}
+		var runtimeErr *RuntimeError
+		if !errors.As(err, &runtimeErr) || runtimeErr.Code() != test.Code {
+			t.Fatalf("%s: expecting code %s, got %v", test.Expr, test.Code, err)
+		}
+		for _, other := range []*ErrorKind{ErrDivisionByZero, ErrTypeMismatch, ErrFunction} {
+			if other != test.Kind && errors.Is(err, other) {
+				t.Fatalf("%s: unexpectedly matched %s", test.Expr, other.Code)
+			}
+		}
+	}
+
+	_, err := Evaluate(`=FAIL()`, source)
+	if !errors.Is(err, funcErr) {
+		t.Fatalf("expecting wrapped function error, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = EvaluateContext(ctx, `=a`, source)
+	if !errors.Is(err, ErrCanceled) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("expecting canceled error, got %v", err)
+	}
+}
+
+func TestEvalOptions(t *testing.T) {
+	tests := []struct {
+		Expr    string
+		Options EvalOptions
+		Error   bool
+	}{
+		{`=REPT(REPT("x"; 100000); 100000)`, EvalOptions{MaxStringLength: 1 << 20}, true},
+		{`=REPT("x"; 1000)`, EvalOptions{MaxStringLength: 1000}, false},
+		{`=REPT("x"; 1001)`, EvalOptions{MaxStringLength: 1000}, true},
+		{`=REPT("ab"; 4611686018427387904)`, EvalOptions{MaxStringLength: 100}, true},
+		{`=REPT("ab"; 4611686018427387904)`, EvalOptions{}, true},
+		{`=REPT(""; 100000000000000000000)`, EvalOptions{}, true},
+		{`=REPT("x"; 10^18)`, EvalOptions{}, true},
+		{`=REPT("x"; 10^10)`, EvalOptions{}, true},
+		{`=REPT("x"; 10^10)`, EvalOptions{MaxStringLength: 1 << 40}, true},
+		{`=LEN(REPT("x"; 10^6))`, EvalOptions{}, false},
+		{`=MAKEARRAY(10^5; 10^5; LAMBDA(r; c; 1))`, EvalOptions{}, true},
+		{`=ROWS(MAKEARRAY(1000; 10; LAMBDA(r; c; 1)))`, EvalOptions{}, false},
+		{`=REPT(""; 1000)`, EvalOptions{MaxStringLength: 1}, false},
+		{`=JOIN(", "; "abc"; "def")`, EvalOptions{MaxStringLength: 10}, false},
+		{`=JOIN(", "; "abc"; "def"; "g")`, EvalOptions{MaxStringLength: 10}, true},
+		{`=CHAR(65; 66; 67)`, EvalOptions{MaxStringLength: 2}, true},
+		{`="abc" & "def"`, EvalOptions{MaxStringLength: 5}, true},
+		{`=UPPER("abcdef")`, EvalOptions{MaxStringLength: 5}, true},
+		{`={1; 2 | 3; 4}`, EvalOptions{MaxArraySize: 4}, false},
+		{`={1; 2; 3 | 4; 5; 6}`, EvalOptions{MaxArraySize: 4}, true},
+		{`=MAKEARRAY(2; 2; LAMBDA(r; c; r * c))`, EvalOptions{MaxArraySize: 4}, false},
+		{`=MAKEARRAY(1000000; 1000000; LAMBDA(r; c; r * c))`, EvalOptions{MaxArraySize: 100, MaxCalls: 1000}, true},
+		{`=BYROW(list; LAMBDA(row; 1))`, EvalOptions{MaxArraySize: 4}, true},
+		{`=ROWS(list)`, EvalOptions{MaxArraySize: 4}, false},
+		{`=MAP(list; LAMBDA(x; x))`, EvalOptions{MaxArraySize: 4}, true},
+		{`=1 + 2 + 3`, EvalOptions{MaxSteps: 5}, false},
+		{`=1 + 2 + 3 + 4`, EvalOptions{MaxSteps: 5}, true},
+		{`=LET(f; LAMBDA(f; n; IF(n = 0; 0; f(f; n - 1))); f(f; 100))`, EvalOptions{MaxSteps: 100}, true},
+		{`=ABS(ABS(ABS(1)))`, EvalOptions{MaxCalls: 3}, false},
+		{`=ABS(ABS(ABS(ABS(1))))`, EvalOptions{MaxCalls: 3}, true},
+		{`=LET(f; LAMBDA(f; n; IF(n = 0; 0; f(f; n - 1))); f(f; 10))`, EvalOptions{MaxCallDepth: 20}, false},
+		{`=LET(f; LAMBDA(f; n; IF(n = 0; 0; f(f; n - 1))); f(f; 30))`, EvalOptions{MaxCallDepth: 20}, true},
+	}
+	source := Sources{Base, SourceMap{"list": []float64{1, 2, 3, 4, 5}}}
+	for _, test := range tests {
+		e, err := Parse(test.Expr)
+		if err != nil {
+			t.Fatalf("%s: %s", test.Expr, err)
+		}
+		_, err = test.Options.Evaluate(e, source)
+		if !test.Error {
+			if err != nil {
+				t.Fatalf("%s: unexpected error %s", test.Expr, err)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrLimitExceeded) {
+			t.Fatalf("%s: expecting limit error, got %v", test.Expr, err)
+		}
+	}
+
+	// Go runtime panics of functions fail the evaluation
+	fns := SourceMap{"FIRST": func(c *Call) (interface{}, error) {
+		return c.Values[0], nil
+	}}
+	_, err := Evaluate(`=1 + FIRST()`, fns)
+	var runtimeErr *RuntimeError
+	if !errors.As(err, &runtimeErr) || !errors.Is(err, ErrFunction) || runtimeErr.Span != (Span{5, 12}) {
+		t.Fatalf("expecting function error, got %#v", err)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	policy := &Policy{
+		DenyFunctions:    []string{"RAND"},
+		AllowIdentifiers: []string{"price", "qty"},
+	}
+	opts := ParseOptions{Policy: policy}
+
+	if _, err := opts.Parse(`=ABS(price * qty)`); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if _, err := opts.Parse(`=LET(secret; 2; price * secret)`); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	_, err := opts.Parse(`=price * RAND()`)
+	var policyErr *PolicyError
+	if !errors.As(err, &policyErr) || policyErr.Name != "RAND" || !policyErr.Function || policyErr.Span != (Span{9, 15}) {
+		t.Fatalf("expecting policy error for RAND, got %#v", err)
+	}
+	if !errors.Is(err, ErrPolicyViolation) {
+		t.Fatalf("expecting ErrPolicyViolation, got %v", err)
+	}
+	_, err = opts.Parse(`=price * secret`)
+	if !errors.As(err, &policyErr) || policyErr.Name != "secret" || policyErr.Function {
+		t.Fatalf("expecting policy error for secret, got %#v", err)
+	}
+
+	// functions that are called indirectly
+	indirect := []struct {
+		Expr string
+		Span Span
+		// Allowlist is true if the call is also detected by AllowFunctions
+		Allowlist bool
+	}{
+		{`=LET(f; RAND; f())`, Span{8, 12}, true},
+		{`=(RAND)()`, Span{2, 6}, true},
+		{`=LAMBDA(g; g())(RAND)`, Span{16, 20}, false},
+	}
+	allowed := ParseOptions{Policy: &Policy{AllowFunctions: []string{"ABS"}}}
+	for _, test := range indirect {
+		_, err := opts.Parse(test.Expr)
+		if !errors.As(err, &policyErr) || policyErr.Name != "RAND" || !policyErr.Function || policyErr.Span != test.Span {
+			t.Fatalf("%s: expecting policy error for RAND, got %#v", test.Expr, err)
+		}
+		if test.Allowlist {
+			_, err = allowed.Parse(test.Expr)
+			if !errors.As(err, &policyErr) || policyErr.Name != "RAND" || !policyErr.Function || policyErr.Span != test.Span {
+				t.Fatalf("%s: expecting allowlist policy error for RAND, got %#v", test.Expr, err)
+			}
+		}
+	}
+	if _, err := allowed.Parse(`=LET(f; ABS; g; f; g(x))`); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	var lib Library
+	if err := lib.Define(`NOISE(x) := x * RAND()
+NOISY(x) := 1 + NOISE(x)`); err != nil {
+		t.Fatal(err)
+	}
+	source := PolicySource(Sources{Base, &lib, SourceMap{"price": 2.0, "secret": 3.0}}, policy)
+	e, err := Parse(`=NOISE(price)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = e.Evaluate(source)
+	if !errors.Is(err, ErrPolicyViolation) || !errors.As(err, &policyErr) || policyErr.Name != "RAND" || policyErr.Span != (Span{1, 13}) {
+		t.Fatalf("expecting policy error for RAND, got %v", err)
+	}
+	if _, err := Evaluate(`=secret`, source); !errors.Is(err, ErrPolicyViolation) {
+		t.Fatalf("expecting policy error for secret, got %v", err)
+	}
+
+	// denials during evaluation are located at the expression being evaluated
+	denied := []struct {
+		Expr string
+		Name string
+		Span Span
+	}{
+		{`=price * secret`, "secret", Span{9, 15}},
+		{`=1 + NOISE(NOISE(price))`, "RAND", Span{11, 23}},
+		{`=price * NOISY(2)`, "RAND", Span{9, 17}},
+		{`=ABS(price) + MAP({1; 2}; NOISE)`, "RAND", Span{14, 32}},
+		{`=LET(f; LAMBDA(x; x * RAND()); price + f(1))`, "RAND", Span{22, 28}},
+	}
+	for _, test := range denied {
+		e, err := Parse(test.Expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = e.Evaluate(source)
+		if !errors.As(err, &policyErr) || policyErr.Name != test.Name || policyErr.Span != test.Span || err.(*RuntimeError).Span != test.Span {
+			t.Fatalf("%s: expecting policy error for %s at %v, got %#v", test.Expr, test.Name, test.Span, err)
+		}
+	}
+	testNumber(t, `=ABS(price - 4)`, 2, source)
+
+	for _, name := range source.(EnumerableSource).Names() {
+		if name == "RAND" {
+			t.Fatalf("unexpected name %s", name)
+		}
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	var lib Library
+	if err := lib.Define(`NOISE(x) := x * RAND()
+NOISY(x) := NOISE(x) + 1
+DOUBLE(x) := x * 2`); err != nil {
+		t.Fatal(err)
+	}
+	sample := VolatileFunc(func(c *Call) (interface{}, error) {
+		return c.Random(), nil
+	})
+	var outer Library
+	if err := outer.Define(`JITTER(x) := x + SAMPLE()
+WRAP(x) := JITTER(x) * DOUBLE(x)`); err != nil {
+		t.Fatal(err)
+	}
+	source := Sources{Base, &lib, &outer, SourceMap{"SAMPLE": sample, "x": 1.0}}
+	tests := []struct {
+		Expr          string
+		Deterministic bool
+	}{
+		{`=1 + 2`, true},
+		{`=ABS(-1) + DOUBLE(2)`, true},
+		{`=RAND()`, false},
+		{`=IF(TRUE(); 1; NOW())`, false},
+		{`=TODAY() + 1`, false},
+		{`=NOISY(2)`, false},
+		{`=LET(RAND; LAMBDA(1); RAND())`, true},
+		{`=LET(f; RAND; f())`, false},
+		{`=(RAND)()`, false},
+		{`=LAMBDA(g; g())(TODAY)`, false},
+		{`=SAMPLE()`, false},
+		{`=JITTER(x)`, false},
+		{`=WRAP(x)`, false},
+		{`=LET(SAMPLE; LAMBDA(1); JITTER(x))`, false},
+		{`=DOUBLE(x)`, true},
+	}
+	for _, test := range tests {
+		e, err := Parse(test.Expr)
+		if err != nil {
+			t.Fatalf("%s: %s", test.Expr, err)
+		}
+		if d := e.Deterministic(source); d != test.Deterministic {
+			t.Fatalf("%s: expecting %v, got %v", test.Expr, test.Deterministic, d)
+		}
+	}
+
+	e, err := Parse(`=RAND() + NOISY(10)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := WithSeed(context.Background(), 42)
+	first, err := Number(e.EvaluateContext(ctx, source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Number(e.EvaluateContext(ctx, source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Fatalf("expecting equal results, got %f and %f", first, second)
+	}
+	e, err = Parse(`=RAND() = RAND()`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if equal, err := Boolean(e.EvaluateContext(ctx, source)); err != nil || equal {
+		t.Fatalf("expecting different random numbers, got %v, %v", equal, err)
+	}
+
+	clock := func() time.Time {
+		return time.Date(2020, time.March, 1, 18, 0, 0, 0, time.UTC)
+	}
+	ctx = WithClock(context.Background(), clock)
+	e, err = Parse(`=TEXT(NOW(); "yyyy-mm-dd hh:mm") & " " & TEXT(TODAY(); "hh:mm") & " " & TEXT(NOW() - TODAY(); "0.00")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := String(e.EvaluateContext(ctx, Base))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "2020-03-01 18:00 00:00 0.75" {
+		t.Fatalf("unexpected result %s", result)
+	}
+}
+
+func TestFuncDef(t *testing.T) {
+	area := &FuncDef{
+		Name: "AREA",
+		Params: []Param{
+			{Name: "width", Type: TypeNumber},
+			{Name: "height", Type: TypeNumber, Optional: true, Default: float64(1)},
+			{Name: "unit", Type: TypeString, Optional: true},
+		},
+		Returns:     TypeNumber,
+		Description: "Returns the area of a rectangle.",
+		Examples:    []string{`=AREA(2; 3)`},
+		Pure:        true,
+		Func: func(c *Call) (interface{}, error) {
+			return c.Number(0) * c.Number(1), nil
+		},
+	}
+	source := SourceMap{"AREA": area}
+	testNumber(t, `=AREA(2; 3)`, 6, source)
+	testNumber(t, `=AREA(2)`, 2, source)
+	testNumber(t, `=AREA(2; 3; "m")`, 6, source)
+	testRuntimeError(t, `=AREA()`, "AREA expects 1 to 3 arguments", source)
+	testRuntimeError(t, `=AREA(1; 2; "m"; 4)`, "AREA expects 1 to 3 arguments", source)
+	testRuntimeError(t, `=AREA(1; "2")`, "AREA expects argument 1 to be number", source)
+	testRuntimeError(t, `=JOIN(","; "a"; 1)`, "JOIN expects argument 2 to be string", Base)
+	testRuntimeError(t, `=CHAR(65; "B")`, "CHAR expects argument 1 to be number", Base)
+	testRuntimeError(t, `=TEXT(1)`, "TEXT expects 2 arguments", Base)
+	testRuntimeError(t, `=ABS(1; 2)`, "ABS expects 1 arguments", Base)
+
+	// Base functions used to ignore extra arguments
+	for _, expr := range []string{`=ABS(1; 2)`, `=LEN("a"; "b")`, `=PI(1)`, `=TYPE(1; 2)`, `=UPPER("a"; 1)`} {
+		if _, err := Evaluate(expr); !errors.Is(err, ErrArgumentCount) {
+			t.Fatalf("%s: expecting argument count error, got %v", expr, err)
+		}
+	}
+
+	if sig := area.Signature(); sig != `AREA(number width; number height = 1; [string unit]) number` {
+		t.Fatalf("unexpected signature %s", sig)
+	}
+	signatures := map[string]string{
+		"CHOOSE": `CHOOSE(number index; ANY...) ANY`,
+		"FIXED":  `FIXED(number a; number decimals = 2; bool noCommas = FALSE()) string`,
+		"JOIN":   `JOIN(string sep; string...) string`,
+		"PI":     `PI() number`,
+		"SEARCH": `SEARCH(string needle; string haystack; number start = 1) number`,
+	}
+	defs := FuncDefs(Sources{Base, source})
+	for _, def := range defs {
+		if expected, ok := signatures[def.Name]; ok && def.Signature() != expected {
+			t.Fatalf("expecting signature %s, got %s", expected, def.Signature())
+		}
+		if def.Description == "" || len(def.Examples) == 0 {
+			t.Fatalf("%s is not documented", def.Name)
+		}
+		if def.Pure == def.Volatile {
+			t.Fatalf("%s must either be pure or volatile", def.Name)
+		}
+		for _, example := range def.Examples {
+			if _, err := Evaluate(example, source); err != nil {
+				t.Fatalf("%s: %s", example, err)
+			}
+		}
+	}
+	if len(defs) != len(baseFuncs)+1 || defs[0].Name != "ABS" || defs[1].Name != "AREA" {
+		t.Fatalf("unexpected definitions %v", defs)
+	}
+
+	const expected = "AREA(number width; number height = 1; [string unit]) number\n  Returns the area of a rectangle.\n  Example: =AREA(2; 3)\n"
+	if docs := FormatDocs([]*FuncDef{area}); docs != expected {
+		t.Fatalf("unexpected docs %q", docs)
+	}
+}
+
+func TestEvaluateTrace(t *testing.T) {
+	source := Sources{Base, SourceMap{"x": 7.0, "y": "b"}}
+	tests := []struct {
+		Expr    string
+		Explain string
+	}{
+		{`=AND(x > 5; y = "a")`, `AND(x > 5 → TRUE; y = "a" → FALSE) → FALSE`},
+		{`=IF(x > 50; "big"; "small")`, `IF(x > 50 → FALSE; "big" → not evaluated; "small" → "small") → "small"`},
+		{`=OR(x > 5; 1 / 0 = 1)`, `OR(x > 5 → TRUE; 1 / 0 = 1 → not evaluated) → TRUE`},
+		{`=LET(f; LAMBDA(a; a * 2); f(x) + LEN(y))`, `LET(f; LAMBDA(a; a * 2) → function; f(x → 7) + LEN(y → "b") → 15) → 15`},
+		{`=AND(x > 5; 1 / 0 = 1)`, `AND(x > 5 → TRUE; 1 / 0 = 1 → error) → error`},
+		{`=x`, `x → 7`},
+	}
+	for _, test := range tests {
+		e, err := Parse(test.Expr)
+		if err != nil {
+			t.Fatalf("%s: %s", test.Expr, err)
+		}
+		_, trace, _ := e.EvaluateTrace(context.Background(), source)
+		if explain := trace.Explain(); explain != test.Explain {
+			t.Fatalf("%s: expecting %s, got %s", test.Expr, test.Explain, explain)
+		}
+	}
+
+	e, err := Parse(`=LET(f; LAMBDA(a; a * 2); f(1) + f(2))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, trace, err := e.EvaluateTrace(context.Background(), source)
+	if err != nil || val != 6.0 || trace.Root.Value != 6.0 || trace.Root.Span != (Span{1, 38}) {
+		t.Fatalf("unexpected result %v, %v, %#v", val, err, trace.Root)
+	}
+	bodies := 0
+	var visit func(n *TraceNode)
+	visit = func(n *TraceNode) {
+		if n.Duration < 0 {
+			t.Fatalf("negative duration %s", n.Duration)
+		}
+		if n.Span == (Span{18, 23}) {
+			bodies++
+		}
+		for _, child := range n.Children {
+			visit(child)
+		}
+	}
+	visit(trace.Root)
+	if bodies != 2 {
+		t.Fatalf("expecting the body to be evaluated twice, got %d", bodies)
+	}
+
+	_, trace, err = EvalOptions{MaxSteps: 3}.EvaluateTrace(context.Background(), e, source)
+	if !errors.Is(err, ErrLimitExceeded) || trace.Root.Err == nil || trace.Root.Value != nil {
+		t.Fatalf("expecting limit error, got %v", err)
+	}
+}
+
+type testHook struct {
+	before func(ctx context.Context, step *Step)
+	after  func(ctx context.Context, step *Step)
+}
+
+func (h *testHook) Before(ctx context.Context, step *Step) {
+	if h.before != nil {
+		h.before(ctx, step)
+	}
+}
+
+func (h *testHook) After(ctx context.Context, step *Step) {
+	if h.after != nil {
+		h.after(ctx, step)
+	}
+}
+
+func TestHook(t *testing.T) {
+	const expr = `=LET(a; x + 1; IF(a > 1; LEN(y); 0))`
+	e, err := Parse(expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := Sources{Base, SourceMap{"x": 1.0, "y": "abc"}}
+
+	var log []string
+	var inspected interface{}
+	hook := &testHook{
+		before: func(ctx context.Context, step *Step) {
+			log = append(log, strings.Repeat(" ", step.Depth)+expr[step.Span.Start:step.Span.End])
+			if expr[step.Span.Start:step.Span.End] == "LEN(y)" {
+				inspected, _ = step.Source.Get(ctx, "a")
+			}
+		},
+		after: func(ctx context.Context, step *Step) {
+			log = append(log, strings.Repeat(" ", step.Depth)+"= "+fmt.Sprint(step.Value))
+		},
+	}
+	ctx := WithHook(context.Background(), hook)
+	val, err := e.EvaluateContext(ctx, source)
+	if err != nil || val != 3.0 {
+		t.Fatalf("unexpected result %v, %v", val, err)
+	}
+	if inspected != 2.0 {
+		t.Fatalf("expecting a to be 2, got %v", inspected)
+	}
+	expected := []string{
+		`LET(a; x + 1; IF(a > 1; LEN(y); 0))`,
+		` x + 1`,
+		`  x`,
+		`  = 1`,
+		`  1`,
+		`  = 1`,
+		` = 2`,
+		` IF(a > 1; LEN(y); 0)`,
+		`  a > 1`,
+		`   a`,
+		`   = 2`,
+		`   1`,
+		`   = 1`,
+		`  = true`,
+		`  LEN(y)`,
+		`   y`,
+		`   = abc`,
+		`  = 3`,
+		` = 3`,
+		`= 3`,
+	}
+	if !reflect.DeepEqual(log, expected) {
+		t.Fatalf("unexpected steps:\n%s", strings.Join(log, "\n"))
+	}
+
+	// abort when a breakpoint is reached
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var failed *Step
+	hook = &testHook{
+		before: func(ctx context.Context, step *Step) {
+			if expr[step.Span.Start:step.Span.End] == "LEN(y)" {
+				cancel()
+			}
+		},
+		after: func(ctx context.Context, step *Step) {
+			if failed == nil && step.Err != nil {
+				failed = step
+			}
+		},
+	}
+	_, err = e.EvaluateContext(WithHook(ctx, hook), source)
+	if !errors.Is(err, ErrCanceled) {
+		t.Fatalf("expecting canceled error, got %v", err)
+	}
+	if failed == nil || expr[failed.Span.Start:failed.Span.End] != "LEN(y)" || failed.Value != nil {
+		t.Fatalf("unexpected failed step %#v", failed)
+	}
+
+	// hooks are combined with tracing
+	steps := 0
+	hook = &testHook{
+		before: func(ctx context.Context, step *Step) {
+			steps++
+		},
+	}
+	_, trace, err := e.EvaluateTrace(WithHook(context.Background(), hook), source)
+	if err != nil || steps != 10 || trace.Root.Value != 3.0 {
+		t.Fatalf("unexpected result %d, %v, %v", steps, trace.Root.Value, err)
+	}
+}
+
+func TestProfiler(t *testing.T) {
+	e, err := Parse(`=LET(f; LAMBDA(n; ABS(n) + LEN(y)); f(x) + f(x + 1))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := Sources{Base, SourceMap{"x": 1.0, "y": "abc"}}
+
+	var p Profiler
+	ctx := WithHook(context.Background(), &p)
+	for i := 0; i < 3; i++ {
+		if val, err := e.EvaluateContext(ctx, source); err != nil || val != 9.0 {
+			t.Fatalf("unexpected result %v, %v", val, err)
+		}
+	}
+
+	entries := make(map[string]ProfileEntry)
+	for _, entry := range p.Entries() {
+		entries[entry.Kind.String()+" "+entry.Name] = entry
+		if entry.Self < 0 || entry.Total < entry.Self {
+			t.Fatalf("unexpected times %#v", entry)
+		}
+	}
+	counts := map[string]int64{
+		"expression =LET(f; LAMBDA(n; ABS(n) + LEN(y)); f(x) + f(x + 1))": 3,
+		"function f":   6,
+		"function ABS": 6,
+		"function LEN": 6,
+		"identifier x": 6,
+		"identifier y": 6,
+	}
+	for name, count := range counts {
+		if entries[name].Count != count {
+			t.Fatalf("expecting %s to be counted %d times, got %#v", name, count, entries[name])
+		}
+	}
+	if root := p.Entries()[0]; root.Kind != ProfileExpression {
+		t.Fatalf("expecting the expression to have the largest total, got %#v", root)
+	}
+
+	var buf bytes.Buffer
+	if err := p.WriteProfile(&buf); err != nil {
+		t.Fatal(err)
+	}
+	r, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, str := range []string{"f()", "ABS()", "identifier", "nanoseconds"} {
+		if !bytes.Contains(data, []byte(str)) {
+			t.Fatalf("expecting profile to contain %q", str)
+		}
+	}
+
+	p.Reset()
+	if entries := p.Entries(); len(entries) != 0 {
+		t.Fatalf("expecting no entries after reset, got %v", entries)
+	}
+}
+
 func testSyntaxError(t *testing.T, expr, messageRegex string, source Source) {
 	_, err := Parse(expr)
 	if err == nil {
@@ -0,0 +1,601 @@
+package exprel
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// serialEpoch is the date that corresponds to the serial number 0.
+var serialEpoch = time.Date(1899, time.December, 30, 0, 0, 0, 0, time.UTC)
+
+// minDateSerial and maxDateSerial are the serial date numbers of the first day
+// of the year 1 and of the year 10000, which bound the dates that can be
+// formatted.
+const (
+	minDateSerial = -693593
+	maxDateSerial = 2958466
+)
+
+// serialToTime converts a spreadsheet serial date number to a time, rounded to
+// the nearest second.
+func serialToTime(serial float64) time.Time {
+	seconds := math.Round(serial * 86400)
+	days := math.Floor(seconds / 86400)
+	t := serialEpoch.AddDate(0, 0, int(days))
+	return t.Add(time.Duration(seconds-days*86400) * time.Second)
+}
+
+// parseNumber parses s as a number, where decimal and group are the decimal
+// and grouping separators. Whitespace, a leading currency sign, enclosing
+// parentheses (indicating a negative number), and trailing percent signs are
+// permitted.
+func parseNumber(s string, decimal, group string) (float64, bool) {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, s)
+
+	percent := 0
+	for strings.HasSuffix(s, "%") {
+		s = s[:len(s)-1]
+		percent++
+	}
+	negative := false
+	if strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")") {
+		s = s[1 : len(s)-1]
+		negative = true
+	}
+	if strings.HasPrefix(s, "-") {
+		s = s[1:]
+		negative = !negative
+	} else if strings.HasPrefix(s, "+") {
+		s = s[1:]
+	}
+	s = strings.TrimPrefix(s, "$")
+
+	if group != "" {
+		s = strings.Replace(s, group, "", -1)
+	}
+	if decimal != "." {
+		if strings.Contains(s, ".") {
+			return 0, false
+		}
+		s = strings.Replace(s, decimal, ".", 1)
+	}
+	if s == "" || s == "." {
+		return 0, false
+	}
+	for i, r := range s {
+		switch {
+		case r >= '0' && r <= '9', r == '.':
+		case (r == 'e' || r == 'E') && i > 0:
+		case (r == '+' || r == '-') && i > 0 && (s[i-1] == 'e' || s[i-1] == 'E'):
+		default:
+			return 0, false
+		}
+	}
+	number, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+	for ; percent > 0; percent-- {
+		number /= 100
+	}
+	if negative {
+		number = -number
+	}
+	return number, true
+}
+
+// roundDigits rounds number half away from zero to the given number of
+// decimal digits. digits may be negative, in which case number is rounded to
+// the left of the decimal point.
+func roundDigits(number float64, digits int) float64 {
+	p := math.Pow(10, math.Abs(float64(digits)))
+	scaled := number * p
+	if digits < 0 {
+		scaled = number / p
+	}
+	if math.IsInf(scaled, 0) || math.IsNaN(scaled) {
+		// number has no digits beyond the given number of decimal digits
+		return number
+	}
+	// discard binary representation error (e.g. 2.675 * 100 = 267.49999...)
+	scaled, _ = strconv.ParseFloat(strconv.FormatFloat(scaled, 'g', 15, 64), 64)
+	if digits < 0 {
+		return math.Round(scaled) * p
+	}
+	return math.Round(scaled) / p
+}
+
+// groupThousands inserts sep between every group of three digits of the
+// integer string s.
+func groupThousands(s string, sep string) string {
+	if len(s) <= 3 {
+		return s
+	}
+	var b strings.Builder
+	first := len(s) % 3
+	if first > 0 {
+		b.WriteString(s[:first])
+	}
+	for i := first; i < len(s); i += 3 {
+		if b.Len() > 0 {
+			b.WriteString(sep)
+		}
+		b.WriteString(s[i : i+3])
+	}
+	return b.String()
+}
+
+// maxDecimals is the largest number of decimals, and of digits to the left of
+// the decimal point, that numbers can be rounded to.
+const maxDecimals = 308
+
+// decimalsArg returns argument i of c, the number of decimals to which a number
+// is rounded, as an int. An error of kind ErrInvalidArgument is raised if it
+// is outside the range [-maxDecimals, maxDecimals].
+func decimalsArg(c *Call, i int) int {
+	decimals := c.Number(i)
+	if !(math.Abs(decimals) <= maxDecimals) {
+		panic(&RuntimeError{Message: c.Name + " decimals out of range", Kind: ErrInvalidArgument})
+	}
+	return int(decimals)
+}
+
+// formatFixed formats number with the given number of decimals, optionally
+// grouping thousands with commas.
+func formatFixed(number float64, decimals int, commas bool) string {
+	number = roundDigits(number, decimals)
+	if decimals < 0 {
+		decimals = 0
+	}
+	str := strconv.FormatFloat(math.Abs(number), 'f', decimals, 64)
+	intPart, fracPart := str, ""
+	if i := strings.IndexByte(str, '.'); i >= 0 {
+		intPart, fracPart = str[:i], str[i:]
+	}
+	if commas {
+		intPart = groupThousands(intPart, ",")
+	}
+	if number < 0 {
+		return "-" + intPart + fracPart
+	}
+	return intPart + fracPart
+}
+
+const (
+	fmtLiteral = 'l'
+	fmtDate    = 'd'
+	fmtText    = '@'
+)
+
+type fmtToken struct {
+	Kind rune
+	Text string
+}
+
+func isDigitPlaceholder(r rune) bool {
+	return r == '0' || r == '#' || r == '?'
+}
+
+// splitFormat splits a format string into its ';' separated sections.
+func splitFormat(format string) []string {
+	var sections []string
+	start := 0
+	inQuote := false
+	for i := 0; i < len(format); i++ {
+		switch format[i] {
+		case '"':
+			inQuote = !inQuote
+		case '\\':
+			if !inQuote {
+				i++
+			}
+		case ';':
+			if !inQuote {
+				sections = append(sections, format[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(sections, format[start:])
+}
+
+func tokenizeFormat(section string) []fmtToken {
+	var tokens []fmtToken
+	rs := []rune(section)
+	for i := 0; i < len(rs); i++ {
+		r := rs[i]
+		lower := unicode.ToLower(r)
+		switch {
+		case r == '"':
+			j := i + 1
+			for j < len(rs) && rs[j] != '"' {
+				j++
+			}
+			tokens = append(tokens, fmtToken{fmtLiteral, string(rs[i+1 : j])})
+			i = j
+		case r == '\\' && i+1 < len(rs):
+			tokens = append(tokens, fmtToken{fmtLiteral, string(rs[i+1])})
+			i++
+		case r == '_' && i+1 < len(rs):
+			tokens = append(tokens, fmtToken{fmtLiteral, " "})
+			i++
+		case r == '*' && i+1 < len(rs):
+			i++
+		case r == '[':
+			j := i + 1
+			for j < len(rs) && rs[j] != ']' {
+				j++
+			}
+			if j == len(rs) {
+				tokens = append(tokens, fmtToken{fmtLiteral, string(r)})
+				continue
+			}
+			content := strings.ToLower(string(rs[i+1 : j]))
+			if content != "" && strings.Trim(content, string(content[0])) == "" && strings.ContainsAny(content[:1], "hms") {
+				tokens = append(tokens, fmtToken{fmtDate, "[" + content + "]"})
+			}
+			// colors and conditions are ignored
+			i = j
+		case isDigitPlaceholder(r), r == '.', r == ',', r == '%', r == '@':
+			tokens = append(tokens, fmtToken{r, string(r)})
+		case hasPrefixFold(rs[i:], "am/pm"):
+			tokens = append(tokens, fmtToken{fmtDate, "am/pm"})
+			i += 4
+		case hasPrefixFold(rs[i:], "a/p"):
+			tokens = append(tokens, fmtToken{fmtDate, "a/p"})
+			i += 2
+		case lower == 'y', lower == 'm', lower == 'd', lower == 'h', lower == 's':
+			j := i + 1
+			for j < len(rs) && unicode.ToLower(rs[j]) == lower {
+				j++
+			}
+			tokens = append(tokens, fmtToken{fmtDate, strings.ToLower(string(rs[i:j]))})
+			i = j - 1
+		default:
+			tokens = append(tokens, fmtToken{fmtLiteral, string(r)})
+		}
+	}
+	return tokens
+}
+
+func hasPrefixFold(rs []rune, prefix string) bool {
+	p := []rune(prefix)
+	if len(rs) < len(p) {
+		return false
+	}
+	return strings.EqualFold(string(rs[:len(p)]), prefix)
+}
+
+// formatText formats value using a spreadsheet number format. value must be
+// a string, float64, or bool. ok is false if a date or elapsed time code is
+// applied to a number that is out of range.
+func formatText(value interface{}, format string) (text string, ok bool) {
+	sections := splitFormat(format)
+
+	var number float64
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return "TRUE", true
+		}
+		return "FALSE", true
+	case float64:
+		number = v
+	case string:
+		n, ok := parseNumber(v, ".", ",")
+		if !ok {
+			if len(sections) >= 4 {
+				return formatLiterals(tokenizeFormat(sections[3]), v), true
+			}
+			if len(sections) == 1 && strings.Contains(sections[0], "@") {
+				return formatLiterals(tokenizeFormat(sections[0]), v), true
+			}
+			return v, true
+		}
+		number = n
+	}
+
+	section := sections[0]
+	signed := true
+	switch {
+	case number < 0 && len(sections) >= 2:
+		section = sections[1]
+		number = -number
+		signed = false
+	case number == 0 && len(sections) >= 3:
+		section = sections[2]
+	}
+	if strings.EqualFold(strings.TrimSpace(section), "general") {
+		return strconv.FormatFloat(number, 'f', -1, 64), true
+	}
+
+	tokens := tokenizeFormat(section)
+	for _, tkn := range tokens {
+		if tkn.Kind == fmtDate {
+			return formatDate(number, tokens)
+		}
+	}
+	for _, tkn := range tokens {
+		if isDigitPlaceholder(tkn.Kind) {
+			return formatNumber(number, tokens, signed), true
+		}
+	}
+	return formatLiterals(tokens, ""), true
+}
+
+// formatLiterals formats a section that contains no placeholders, replacing
+// '@' with text.
+func formatLiterals(tokens []fmtToken, text string) string {
+	var b strings.Builder
+	for _, tkn := range tokens {
+		if tkn.Kind == fmtText {
+			b.WriteString(text)
+		} else {
+			b.WriteString(tkn.Text)
+		}
+	}
+	return b.String()
+}
+
+func formatNumber(number float64, tokens []fmtToken, signed bool) string {
+	decimalIdx := -1
+	firstDigit, lastDigit := -1, -1
+	var intPh, fracPh []rune
+	for i, tkn := range tokens {
+		switch {
+		case tkn.Kind == '.' && decimalIdx == -1:
+			decimalIdx = i
+		case tkn.Kind == '%':
+			number *= 100
+		case isDigitPlaceholder(tkn.Kind):
+			if firstDigit == -1 {
+				firstDigit = i
+			}
+			lastDigit = i
+			if decimalIdx == -1 {
+				intPh = append(intPh, tkn.Kind)
+			} else {
+				fracPh = append(fracPh, tkn.Kind)
+			}
+		}
+	}
+
+	// thousands separators and scaling commas
+	thousands := false
+	scaling := map[int]bool{}
+	for i, tkn := range tokens {
+		if tkn.Kind != ',' {
+			continue
+		}
+		next := -1
+		for j := i + 1; j < len(tokens); j++ {
+			if tokens[j].Kind != ',' {
+				next = j
+				break
+			}
+		}
+		if next != -1 && (isDigitPlaceholder(tokens[next].Kind) && (decimalIdx == -1 || next < decimalIdx)) && i > firstDigit {
+			thousands = true
+			continue
+		}
+		if i > firstDigit && (next == -1 || next == decimalIdx || next > lastDigit) {
+			scaling[i] = true
+			number /= 1000
+		}
+	}
+
+	number = roundDigits(number, len(fracPh))
+	str := strconv.FormatFloat(math.Abs(number), 'f', len(fracPh), 64)
+	intPart, fracPart := str, ""
+	if i := strings.IndexByte(str, '.'); i >= 0 {
+		intPart, fracPart = str[:i], str[i+1:]
+	}
+	negative := number < 0 && strings.Trim(intPart+fracPart, "0") != ""
+
+	if intPart == "0" {
+		intPart = ""
+	}
+	if thousands {
+		intPart = groupThousands(intPart, ",")
+	}
+	var pad []byte
+	for i := len(intPh) - 1 - len(intPart); i >= 0; i-- {
+		switch intPh[i] {
+		case '0':
+			pad = append(pad, '0')
+		case '?':
+			pad = append(pad, ' ')
+		}
+	}
+	for i, j := 0, len(pad)-1; i < j; i, j = i+1, j-1 {
+		pad[i], pad[j] = pad[j], pad[i]
+	}
+	intPart = string(pad) + intPart
+
+	frac := []byte(fracPart)
+	for i := len(frac) - 1; i >= 0 && frac[i] == '0'; i-- {
+		if fracPh[i] == '0' {
+			break
+		}
+		if fracPh[i] == '?' {
+			frac[i] = ' '
+		} else {
+			frac = frac[:i]
+		}
+	}
+	fracPart = string(frac)
+
+	var b strings.Builder
+	if negative && signed {
+		b.WriteByte('-')
+	}
+	wroteInt, wroteFrac := false, false
+	for i, tkn := range tokens {
+		switch {
+		case isDigitPlaceholder(tkn.Kind):
+			if decimalIdx == -1 || i < decimalIdx {
+				if !wroteInt {
+					b.WriteString(intPart)
+					wroteInt = true
+				}
+			} else if !wroteFrac {
+				b.WriteString(fracPart)
+				wroteFrac = true
+			}
+		case tkn.Kind == '.' && i == decimalIdx:
+			if !wroteInt {
+				b.WriteString(intPart)
+				wroteInt = true
+			}
+			b.WriteByte('.')
+		case tkn.Kind == ',':
+			if i < firstDigit || (i > lastDigit && !scaling[i]) {
+				b.WriteByte(',')
+			}
+		default:
+			b.WriteString(tkn.Text)
+		}
+	}
+	return b.String()
+}
+
+var (
+	monthNames = []string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"}
+	dayNames   = []string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"}
+)
+
+// formatDate formats serial using the date and elapsed time codes in tokens.
+// ok is false if serial is outside the range of dates or, for elapsed time
+// codes, if the elapsed seconds are not representable as an int.
+func formatDate(serial float64, tokens []fmtToken) (text string, ok bool) {
+	for _, tkn := range tokens {
+		switch {
+		case tkn.Kind != fmtDate:
+		case tkn.Text[0] == '[':
+			if !(math.Abs(serial*86400) < maxIntFloat) {
+				return "", false
+			}
+		default:
+			if !(serial >= minDateSerial && serial < maxDateSerial) {
+				return "", false
+			}
+		}
+	}
+	t := serialToTime(serial)
+	twelveHour := false
+	for _, tkn := range tokens {
+		if tkn.Kind == fmtDate && (tkn.Text == "am/pm" || tkn.Text == "a/p") {
+			twelveHour = true
+		}
+	}
+
+	// isMinute reports whether the m code at index i refers to minutes, which
+	// is the case when it follows an hour code or precedes a seconds code.
+	isMinute := func(i int) bool {
+		for j := i - 1; j >= 0; j-- {
+			if tokens[j].Kind == fmtDate {
+				if tokens[j].Text[0] == 'h' || strings.HasPrefix(tokens[j].Text, "[h") {
+					return true
+				}
+				break
+			}
+		}
+		for j := i + 1; j < len(tokens); j++ {
+			if tokens[j].Kind == fmtDate {
+				return tokens[j].Text[0] == 's' || strings.HasPrefix(tokens[j].Text, "[s")
+			}
+		}
+		return false
+	}
+
+	pad := func(n int, width int) string {
+		s := strconv.Itoa(n)
+		for len(s) < width {
+			s = "0" + s
+		}
+		return s
+	}
+
+	var b strings.Builder
+	for i, tkn := range tokens {
+		if tkn.Kind != fmtDate {
+			if tkn.Kind == fmtLiteral {
+				b.WriteString(tkn.Text)
+			} else {
+				b.WriteString(string(tkn.Kind))
+			}
+			continue
+		}
+		code := tkn.Text
+		switch {
+		case code == "am/pm", code == "a/p":
+			suffix := "AM"
+			if t.Hour() >= 12 {
+				suffix = "PM"
+			}
+			if code == "a/p" {
+				suffix = suffix[:1]
+			}
+			b.WriteString(suffix)
+		case code[0] == '[':
+			elapsed := serial * 24
+			switch code[1] {
+			case 'm':
+				elapsed *= 60
+			case 's':
+				elapsed *= 3600
+			}
+			b.WriteString(pad(int(math.Floor(elapsed+1e-9)), len(code)-2))
+		case code[0] == 'y':
+			if len(code) <= 2 {
+				b.WriteString(pad(t.Year()%100, 2))
+			} else {
+				b.WriteString(pad(t.Year(), 4))
+			}
+		case code[0] == 'm' && len(code) <= 2 && isMinute(i):
+			b.WriteString(pad(t.Minute(), len(code)))
+		case code[0] == 'm':
+			month := monthNames[t.Month()-1]
+			switch len(code) {
+			case 1, 2:
+				b.WriteString(pad(int(t.Month()), len(code)))
+			case 3:
+				b.WriteString(month[:3])
+			case 4:
+				b.WriteString(month)
+			default:
+				b.WriteString(month[:1])
+			}
+		case code[0] == 'd':
+			day := dayNames[t.Weekday()]
+			switch len(code) {
+			case 1, 2:
+				b.WriteString(pad(t.Day(), len(code)))
+			case 3:
+				b.WriteString(day[:3])
+			default:
+				b.WriteString(day)
+			}
+		case code[0] == 'h':
+			hour := t.Hour()
+			if twelveHour {
+				hour %= 12
+				if hour == 0 {
+					hour = 12
+				}
+			}
+			b.WriteString(pad(hour, len(code)))
+		case code[0] == 's':
+			b.WriteString(pad(t.Second(), len(code)))
+		}
+	}
+	return b.String(), true
+}
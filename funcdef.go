@@ -0,0 +1,280 @@
+package exprel
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Type is the type of an expression value.
+type Type int
+
+// Types of expression values.
+const (
+	// TypeAny matches a value of any type.
+	TypeAny Type = iota
+	TypeNumber
+	TypeString
+	TypeBoolean
+	TypeFunction
+	TypeArray
+	TypeRecord
+)
+
+// String returns the name of the type as it is written in signatures (e.g.
+// "number", "ANY").
+func (t Type) String() string {
+	switch t {
+	case TypeNumber:
+		return "number"
+	case TypeString:
+		return "string"
+	case TypeBoolean:
+		return "bool"
+	case TypeFunction:
+		return "function"
+	case TypeArray:
+		return "array"
+	case TypeRecord:
+		return "record"
+	default:
+		return "ANY"
+	}
+}
+
+// matches reports whether value, an expression value, is of type t.
+func (t Type) matches(value interface{}) bool {
+	switch t {
+	case TypeNumber:
+		_, ok := value.(float64)
+		return ok
+	case TypeString:
+		_, ok := value.(string)
+		return ok
+	case TypeBoolean:
+		_, ok := value.(bool)
+		return ok
+	case TypeFunction:
+		_, ok := value.(Func)
+		return ok
+	case TypeArray:
+		_, ok := value.(Array)
+		return ok
+	case TypeRecord:
+		_, ok := value.(Record)
+		return ok
+	default:
+		return true
+	}
+}
+
+// Param describes a parameter of a FuncDef.
+type Param struct {
+	Name string
+	Type Type
+	// Optional is true if the argument may be omitted. Optional parameters
+	// must follow the required parameters.
+	Optional bool
+	// Default, if non-nil, is passed in place of an omitted optional
+	// argument.
+	Default interface{}
+	// Variadic is true if the parameter accepts any number of arguments,
+	// including none. Only the last parameter may be variadic.
+	Variadic bool
+}
+
+// FuncDef is a function that is described by metadata, which is used to
+// validate its arguments and to document it. Sources may return a *FuncDef in
+// place of a Func; it is converted to a Func by Normalize.
+type FuncDef struct {
+	Name   string
+	Params []Param
+	// Returns is the type of the function's result.
+	Returns Type
+	// Description is a sentence or short paragraph that describes the
+	// function.
+	Description string
+	// Examples contains expressions that demonstrate the function (e.g.
+	// `=ABS(-2)`).
+	Examples []string
+	// Pure is true if the result of the function only depends on its
+	// arguments, and calling the function has no side effects.
+	Pure bool
+	// Volatile is true if the result of the function may differ between calls
+	// with the same arguments (e.g. RAND). Expressions that call a volatile
+	// function are not deterministic.
+	Volatile bool
+	// Func implements the function. It is called once the arguments have been
+	// validated, with omitted arguments replaced by their defaults.
+	Func Func
+
+	// lib and def are set for the functions of a Library
+	lib *Library
+	def *definition
+}
+
+// Call validates the arguments of c against d.Params, then calls d.Func. If
+// the arguments are invalid, Call panics with a *RuntimeError.
+func (d *FuncDef) Call(c *Call) (interface{}, error) {
+	required, max := 0, len(d.Params)
+	variadic := max > 0 && d.Params[max-1].Variadic
+	if variadic {
+		max--
+	}
+	for _, param := range d.Params {
+		if !param.Optional && !param.Variadic {
+			required++
+		}
+	}
+	if len(c.Values) < required || (!variadic && len(c.Values) > max) {
+		switch {
+		case variadic:
+			panic(&RuntimeError{Message: c.Name + " expects at least " + strconv.Itoa(required) + " arguments", Kind: ErrArgumentCount})
+		case required == max:
+			panic(&RuntimeError{Message: c.Name + " expects " + strconv.Itoa(required) + " arguments", Kind: ErrArgumentCount})
+		default:
+			panic(&RuntimeError{Message: c.Name + " expects " + strconv.Itoa(required) + " to " + strconv.Itoa(max) + " arguments", Kind: ErrArgumentCount})
+		}
+	}
+	for i, value := range c.Values {
+		param := d.Params[len(d.Params)-1]
+		if i < max {
+			param = d.Params[i]
+		}
+		if !param.Type.matches(value) {
+			panic(&RuntimeError{Message: c.Name + " expects argument " + strconv.Itoa(i) + " to be " + param.Type.String(), Kind: ErrTypeMismatch})
+		}
+	}
+
+	if len(c.Values) < max && d.Params[len(c.Values)].Default != nil {
+		call := *c
+		call.Values = append([]interface{}(nil), c.Values...)
+		for _, param := range d.Params[len(c.Values):max] {
+			if param.Default == nil {
+				break
+			}
+			call.Values = append(call.Values, param.Default)
+		}
+		c = &call
+	}
+	return d.Func(c)
+}
+
+// Signature returns the signature of d, in the form used by the package
+// documentation:
+//  LEFT(string a; number count = 1) string
+func (d *FuncDef) Signature() string {
+	var b strings.Builder
+	b.WriteString(d.Name)
+	b.WriteByte('(')
+	for i, param := range d.Params {
+		if i > 0 {
+			b.WriteString("; ")
+		}
+		switch {
+		case param.Variadic:
+			b.WriteString(param.Type.String())
+			if param.Name != "" {
+				b.WriteByte(' ')
+				b.WriteString(param.Name)
+			}
+			b.WriteString("...")
+		case param.Optional && param.Default == nil:
+			b.WriteString("[" + param.Type.String() + " " + param.Name + "]")
+		default:
+			b.WriteString(param.Type.String() + " " + param.Name)
+			if param.Optional {
+				b.WriteString(" = " + formatDefault(param.Default))
+			}
+		}
+	}
+	b.WriteString(") ")
+	b.WriteString(d.Returns.String())
+	return b.String()
+}
+
+// formatDefault returns the textual form of the default value of a parameter.
+func formatDefault(value interface{}) string {
+	value, err := Normalize(value)
+	if err != nil {
+		return "?"
+	}
+	switch v := value.(type) {
+	case string:
+		return strconv.Quote(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		if v {
+			return "TRUE()"
+		}
+		return "FALSE()"
+	default:
+		return "?"
+	}
+}
+
+// FuncDefs returns the *FuncDefs of s, sorted by name. Only Sources that
+// implement EnumerableSource can be listed.
+func FuncDefs(s Source) []*FuncDef {
+	var defs []*FuncDef
+	seen := make(map[string]bool)
+	for _, name := range sourceNames(s) {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		value, _ := s.Get(context.Background(), name)
+		if def, ok := value.(*FuncDef); ok && def != nil {
+			defs = append(defs, def)
+		}
+	}
+	sort.Slice(defs, func(i, j int) bool {
+		return defs[i].Name < defs[j].Name
+	})
+	return defs
+}
+
+// FormatDocs returns the documentation of defs, in the form used by the
+// package documentation. Each function is described by its signature,
+// followed by its description and examples, indented:
+//  ABS(number a) number
+//    Returns the absolute value of a.
+//    Example: =ABS(-2)
+func FormatDocs(defs []*FuncDef) string {
+	var b strings.Builder
+	for _, def := range defs {
+		b.WriteString(def.Signature())
+		b.WriteByte('\n')
+		if def.Description != "" {
+			for _, line := range wrapText(def.Description, 76) {
+				b.WriteString("  " + line + "\n")
+			}
+		}
+		for _, example := range def.Examples {
+			b.WriteString("  Example: " + example + "\n")
+		}
+	}
+	return b.String()
+}
+
+// wrapText splits text into lines of at most width bytes, breaking at spaces.
+func wrapText(text string, width int) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(text) {
+		if line != "" && len(line)+1+len(word) > width {
+			lines = append(lines, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += word
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
@@ -0,0 +1,123 @@
+package exprel
+
+import (
+	"context"
+)
+
+// Hook is notified before and after each part of an expression (a literal,
+// identifier, operator, call, etc.) is evaluated. It can be used to build
+// debuggers:
+//  - Before may block to pause the evaluation, e.g. until the user steps to
+//    the next part
+//  - the Source of a Step can be used to inspect the values of identifiers,
+//    including names bound by LET and LAMBDA
+//  - the evaluation is aborted if the context is canceled while Before is
+//    running; it fails with a *RuntimeError of kind ErrCanceled
+//
+// Comparing the depth of steps allows stepping over (the next step with a
+// depth less than or equal to the current one) or into (the next step) a
+// part.
+//
+// The parts of functions defined in a Library are also reported; their spans
+// refer to the function's definition rather than to the expression.
+type Hook interface {
+	// Before is called before the part described by step is evaluated.
+	Before(ctx context.Context, step *Step)
+	// After is called after the part described by step has been evaluated,
+	// with the step's Value or Err set. The step is the same as the one
+	// passed to Before.
+	After(ctx context.Context, step *Step)
+}
+
+// Step describes the evaluation of a part of an expression.
+type Step struct {
+	// Span is the location of the part in the expression's source.
+	Span Span
+	// Depth is the number of enclosing parts that are being evaluated. The
+	// expression as a whole has depth 0.
+	Depth int
+	// Source is the Source with which the part is evaluated.
+	Source Source
+
+	// Value is the result of the part. It is set before After is called, and
+	// is nil if the evaluation failed.
+	Value interface{}
+	// Err is the error that caused the evaluation of the part to fail, if
+	// any. It is set before After is called.
+	Err *RuntimeError
+
+	node node
+}
+
+// WithHook returns a copy of ctx in which expressions that are evaluated
+// notify h of each part that they evaluate.
+func WithHook(ctx context.Context, h Hook) context.Context {
+	return context.WithValue(ctx, hookKey, h)
+}
+
+// hookFrom returns the Hook of ctx, or nil if ctx has no Hook.
+func hookFrom(ctx context.Context) Hook {
+	h, _ := ctx.Value(hookKey).(Hook)
+	return h
+}
+
+// hooks is a Hook that notifies a list of hooks. Before is called in order,
+// and After in reverse order.
+type hooks []Hook
+
+func (h hooks) Before(ctx context.Context, step *Step) {
+	for _, hook := range h {
+		hook.Before(ctx, step)
+	}
+}
+
+func (h hooks) After(ctx context.Context, step *Step) {
+	for i := len(h) - 1; i >= 0; i-- {
+		h[i].After(ctx, step)
+	}
+}
+
+// addHook returns a Hook that notifies h, followed by next. Either may be nil.
+func addHook(h Hook, next Hook) Hook {
+	switch {
+	case h == nil:
+		return next
+	case next == nil:
+		return h
+	default:
+		return hooks{h, next}
+	}
+}
+
+// evaluateHooked evaluates n, notifying the Hook of the evaluation.
+func (ev *evaluation) evaluateHooked(ctx context.Context, n node, s Source) (value interface{}) {
+	step := &Step{
+		Span:   n.span(),
+		Source: s,
+		node:   n,
+	}
+	ev.mu.Lock()
+	step.Depth = ev.depth
+	ev.depth++
+	ev.mu.Unlock()
+
+	ev.hook.Before(ctx, step)
+	defer func() {
+		ev.mu.Lock()
+		ev.depth--
+		ev.mu.Unlock()
+		if rec := recover(); rec != nil {
+			if err, ok := rec.(*RuntimeError); ok {
+				step.Err = err
+			}
+			ev.hook.After(ctx, step)
+			panic(rec)
+		}
+		step.Value = value
+		ev.hook.After(ctx, step)
+	}()
+	if err := ctx.Err(); err != nil {
+		panic(&RuntimeError{Err: err, Kind: ErrCanceled, Span: step.Span})
+	}
+	return evaluateNode(ctx, ev, n, s)
+}
@@ -0,0 +1,231 @@
+package exprel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// JSONSource returns a Source whose identifiers are the members of the JSON
+// object data. data is decoded when the first identifier is looked up.
+//
+// Members of nested objects and elements of arrays are accessed using dotted
+// identifiers (e.g. customer.name, items.0.price). Numbers are decoded as
+// json.Number, so that their precision is preserved until they are converted
+// to float64. Objects evaluate to records, without their null members, and
+// arrays evaluate to arrays with one column, or with one row per element if
+// all elements are arrays (see Normalize).
+//
+// If data is not a valid JSON object, Get panics with a *RuntimeError.
+func JSONSource(data []byte) Source {
+	return &jsonSource{
+		read: func() ([]byte, error) {
+			return data, nil
+		},
+	}
+}
+
+// JSONSourceReader is like JSONSource, but the JSON object is read from r when
+// the first identifier is looked up.
+func JSONSourceReader(r io.Reader) Source {
+	return &jsonSource{
+		read: func() ([]byte, error) {
+			return ioutil.ReadAll(r)
+		},
+	}
+}
+
+type jsonSource struct {
+	read func() ([]byte, error)
+
+	once sync.Once
+	doc  map[string]interface{}
+	err  error
+}
+
+// Get implements Source.
+func (s *jsonSource) Get(ctx context.Context, name string) (interface{}, bool) {
+	s.once.Do(func() {
+		var data []byte
+		data, s.err = s.read()
+		if s.err != nil {
+			return
+		}
+		var doc interface{}
+		if s.err = decodeJSON(data, &doc); s.err != nil {
+			return
+		}
+		var ok bool
+		if s.doc, ok = doc.(map[string]interface{}); !ok {
+			s.err = errors.New("exprel: JSON document is not an object")
+		}
+	})
+	if s.err != nil {
+		panic(&RuntimeError{Err: s.err, Kind: ErrSource})
+	}
+
+	var value interface{} = s.doc
+	for _, part := range strings.Split(name, ".") {
+		var ok bool
+		if value, ok = jsonIndex(value, part); !ok {
+			return nil, false
+		}
+	}
+	return withoutNulls(value), true
+}
+
+func decodeJSON(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("exprel: unexpected data after JSON value")
+	}
+	return nil
+}
+
+// jsonIndex returns the member key of an object or Record, or the element at
+// index key of an array or Array. The elements of an Array with more than one
+// row and column are its rows.
+func jsonIndex(value interface{}, key string) (interface{}, bool) {
+	var length int
+	switch v := value.(type) {
+	case map[string]interface{}:
+		member, ok := v[key]
+		return member, ok
+	case Record:
+		member, ok := v[key]
+		return member, ok
+	case []interface{}:
+		length = len(v)
+	case Array:
+		length = v.Rows()
+		if length == 1 {
+			length = v.Columns()
+		}
+	default:
+		return nil, false
+	}
+	i, err := strconv.Atoi(key)
+	if err != nil {
+		return nil, false
+	}
+	if i < 0 {
+		i += length
+	}
+	if i < 0 || i >= length {
+		return nil, false
+	}
+	switch v := value.(type) {
+	case Array:
+		switch {
+		case v.Rows() == 1:
+			return v[0][i], true
+		case v.Columns() == 1:
+			return v[i][0], true
+		default:
+			return Array{v[i]}, true
+		}
+	default:
+		return value.([]interface{})[i], true
+	}
+}
+
+// withoutNulls returns value, a decoded JSON value, without the null members
+// of its objects.
+func withoutNulls(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		members := make(map[string]interface{}, len(v))
+		for key, member := range v {
+			if member != nil {
+				members[key] = withoutNulls(member)
+			}
+		}
+		return members
+	case []interface{}:
+		elements := make([]interface{}, len(v))
+		for i, element := range v {
+			elements[i] = withoutNulls(element)
+		}
+		return elements
+	}
+	return value
+}
+
+// parseJSONPath parses a path of the form $.a.b[0]['c'] into its keys.
+func parseJSONPath(path string) ([]string, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, errors.New("path must start with $")
+	}
+	var keys []string
+	rest := path[1:]
+	for len(rest) > 0 {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end == -1 {
+				end = len(rest) - 1
+			}
+			key := rest[1 : end+1]
+			if key == "" {
+				return nil, errors.New("empty member name")
+			}
+			keys = append(keys, key)
+			rest = rest[end+1:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end == -1 {
+				return nil, errors.New("missing ]")
+			}
+			key := rest[1:end]
+			if len(key) >= 2 && (key[0] == '\'' || key[0] == '"') && key[len(key)-1] == key[0] {
+				key = key[1 : len(key)-1]
+			} else if _, err := strconv.Atoi(key); err != nil {
+				return nil, errors.New("invalid index " + key)
+			}
+			keys = append(keys, key)
+			rest = rest[end+1:]
+		default:
+			return nil, errors.New("unexpected character '" + rest[:1] + "'")
+		}
+	}
+	return keys, nil
+}
+
+func jsonPath(c *Call) (interface{}, error) {
+	path := c.String(1)
+	keys, err := parseJSONPath(path)
+	if err != nil {
+		panic(&RuntimeError{Message: "JSONPATH invalid path " + path + ": " + err.Error(), Kind: ErrInvalidArgument})
+	}
+	var value interface{}
+	switch doc := c.Values[0].(type) {
+	case string:
+		if err := decodeJSON([]byte(doc), &value); err != nil {
+			panic(&RuntimeError{Message: "JSONPATH invalid document: " + err.Error(), Kind: ErrInvalidArgument})
+		}
+	case Record, Array:
+		value = doc
+	default:
+		panic(&RuntimeError{Message: "JSONPATH expects argument 0 to be string, record or array", Kind: ErrTypeMismatch})
+	}
+	for _, key := range keys {
+		var ok bool
+		if value, ok = jsonIndex(value, key); !ok {
+			panic(&RuntimeError{Message: "JSONPATH path " + path + " not found", Kind: ErrInvalidArgument})
+		}
+	}
+	if value == nil {
+		panic(&RuntimeError{Message: "JSONPATH value at " + path + " is null", Kind: ErrInvalidArgument})
+	}
+	return withoutNulls(value), nil
+}
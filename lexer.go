@@ -1,6 +1,7 @@
 package exprel
 
 import (
+	"io"
 	"strconv"
 	"strings"
 	"unicode"
@@ -24,19 +25,38 @@ const (
 	tknLessEqual    = '≤'
 	tknInequal      = '≠'
 
-	tknSep = ';'
+	tknSep    = ';'
+	tknDefine = '≔'
 
 	tknOpen  = '('
 	tknClose = ')'
+
+	tknArrayOpen  = '{'
+	tknArrayClose = '}'
+	tknColumn     = '\\'
+	tknRow        = '|'
 )
 
 type lexer struct {
-	R *strings.Reader
+	R       *strings.Reader
+	Sep     rune
+	Decimal rune
+	// separators of array columns and rows
+	Column, Row rune
+	// Offset is added to positions, so that they are relative to the
+	// beginning of the expression's source.
+	Offset int
+	// Start is the position of the last token returned by Next.
+	Start int
 }
 
-func newLexer(s string) *lexer {
+func newLexer(s string, opts ParseOptions) *lexer {
 	l := &lexer{
-		R: strings.NewReader(s),
+		R:       strings.NewReader(s),
+		Sep:     opts.argumentSeparator(),
+		Decimal: opts.decimalSeparator(),
+		Column:  opts.arrayColumnSeparator(),
+		Row:     opts.arrayRowSeparator(),
 	}
 	l.skipWhitespace()
 	return l
@@ -55,12 +75,8 @@ func (l *lexer) skipWhitespace() {
 	}
 }
 
-func (l *lexer) HasNext() bool {
-	return l.R.Len() > 0
-}
-
 func (l *lexer) pos() int {
-	return int(l.R.Size()) - l.R.Len()
+	return l.Offset + int(l.R.Size()) - l.R.Len()
 }
 
 // type:
@@ -68,22 +84,30 @@ func (l *lexer) pos() int {
 //  string     -> String
 //  float64    -> Number
 //  rune       -> Token
+//  nil        -> EOF
 func (l *lexer) Next() interface{} {
 	l.skipWhitespace()
+	l.Start = l.pos()
 
 	if l.R.Len() == 0 {
 		// empty reader
-		panic(&SyntaxError{
-			Message:  "unexpected EOF",
-			Position: l.pos(),
-		})
+		return nil
 	}
 
 	r, _, _ := l.R.ReadRune()
 	switch {
-	case r == tknAdd, r == tknSubtract, r == tknMultiply, r == tknDivide, r == tknPower, tknModulo == r, r == tknEquals, r == tknConcat, r == tknSep, r == tknOpen, r == tknClose:
+	case r == tknAdd, r == tknSubtract, r == tknMultiply, r == tknDivide, r == tknPower, tknModulo == r, r == tknEquals, r == tknConcat, r == tknOpen, r == tknClose, r == tknArrayOpen, r == tknArrayClose:
 		// simple operators
 		return r
+	case r == l.Sep:
+		// argument separator
+		return tknSep
+	case r == l.Column:
+		// array column separator, unless it is the argument separator
+		return tknColumn
+	case r == l.Row:
+		// array row separator, unless it is the argument separator
+		return tknRow
 	case r == tknGreater:
 		// greater than, greater than or equal
 		peek, _, err := l.R.ReadRune()
@@ -103,6 +127,16 @@ func (l *lexer) Next() interface{} {
 			return tknLessEqual
 		}
 		return tknInequal
+	case r == ':':
+		// definition
+		peek, _, err := l.R.ReadRune()
+		if err != nil || peek != '=' {
+			panic(&SyntaxError{
+				Message:  "unexpected character '" + string(r) + "'",
+				Position: l.Start,
+			})
+		}
+		return tknDefine
 	case unicode.IsDigit(r):
 		// number
 		l.R.UnreadRune()
@@ -118,17 +152,34 @@ func (l *lexer) Next() interface{} {
 	default:
 		panic(&SyntaxError{
 			Message:  "unexpected character '" + string(r) + "'",
-			Position: l.pos(),
+			Position: l.Start,
 		})
 	}
 }
 
+func isIdentifierRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
 func (l *lexer) nextIdentifier() interface{} {
 	r, _, _ := l.R.ReadRune()
 	chars := []rune{r}
 	for {
 		r, _, err := l.R.ReadRune()
-		if err != nil || (!unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_') {
+		if err == nil && r == '.' {
+			// dotted identifier (e.g. Address.City)
+			peek, size, err := l.R.ReadRune()
+			if err == nil && isIdentifierRune(peek) {
+				chars = append(chars, r, peek)
+				continue
+			}
+			if err != nil {
+				size = 0
+			}
+			l.R.Seek(int64(-size-1), io.SeekCurrent)
+			break
+		}
+		if err != nil || !isIdentifierRune(r) {
 			l.R.UnreadRune()
 			break
 		}
@@ -144,16 +195,16 @@ func (l *lexer) nextString() interface{} {
 		r, _, err := l.R.ReadRune()
 		if err != nil {
 			panic(&SyntaxError{
-				Message:  "unexpected EOF",
-				Position: l.pos(),
+				Message:  "unterminated string",
+				Position: l.Start,
 			})
 		}
 		if r == '\\' {
 			peek, _, err := l.R.ReadRune()
 			if err != nil {
 				panic(&SyntaxError{
-					Message:  "unexpected EOF",
-					Position: l.pos(),
+					Message:  "unterminated string",
+					Position: l.Start,
 				})
 			}
 			if peek == '"' {
@@ -170,8 +221,8 @@ func (l *lexer) nextString() interface{} {
 	str, err := strconv.Unquote(string(chars))
 	if err != nil {
 		panic(&SyntaxError{
-			Message:  err.Error(),
-			Position: l.pos(),
+			Message:  "invalid string: " + err.Error(),
+			Position: l.Start,
 		})
 	}
 	return str
@@ -187,8 +238,11 @@ func (l *lexer) nextNumber() interface{} {
 			l.R.UnreadRune()
 			break
 		}
-		if unicode.IsDigit(r) || r == '.' && !hasDecimal {
+		if unicode.IsDigit(r) {
 			chars = append(chars, r)
+		} else if r == l.Decimal && !hasDecimal {
+			chars = append(chars, '.')
+			hasDecimal = true
 		} else {
 			l.R.UnreadRune()
 			break
@@ -197,8 +251,8 @@ func (l *lexer) nextNumber() interface{} {
 	number, err := strconv.ParseFloat(string(chars), 64)
 	if err != nil {
 		panic(&SyntaxError{
-			Message:  err.Error(),
-			Position: l.pos(),
+			Message:  "invalid number: " + err.Error(),
+			Position: l.Start,
 		})
 	}
 	return number
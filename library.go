@@ -0,0 +1,239 @@
+package exprel
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Library is a collection of user-defined functions that are declared using
+// exprel syntax:
+//  DISCOUNT(price; pct) := price * (1 - pct)
+//  NET(price) := DISCOUNT(price; 0.1) * 1.2
+//
+// Library implements Source; each function is returned as a *FuncDef whose
+// parameters accept any type. When a function is called, its body is
+// evaluated with its parameters bound to the call arguments. Other names are
+// resolved by the Library, followed by the Source with which the calling
+// expression is evaluated. Names bound by LET and LAMBDA in the calling
+// expression are not visible to the body.
+//
+// Functions may not depend on each other recursively. Whether a function is
+// volatile depends on the functions that its body calls, and therefore on the
+// Source with which it is evaluated; Expression.Deterministic checks the
+// bodies of the functions that an expression calls.
+//
+// A Library is safe for concurrent use. The zero value is an empty Library.
+type Library struct {
+	mu    sync.RWMutex
+	defs  map[string]*definition
+	names []string
+}
+
+type definition struct {
+	Name   string
+	Params []string
+	Body   node
+}
+
+// Define parses s, which contains one or more function declarations, and adds
+// them to the library. A declaration replaces an existing function of the same
+// name.
+//
+// If s contains a syntax error, a function with the wrong number of
+// arguments is called, or a recursive dependency would be introduced, an error
+// is returned and the library is left unmodified.
+func (l *Library) Define(s string) error {
+	defs, err := parseDefinitions(s)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	merged := make(map[string]*definition, len(l.defs)+len(defs))
+	for name, def := range l.defs {
+		merged[name] = def
+	}
+	names := append([]string(nil), l.names...)
+	for _, def := range defs {
+		if _, exists := merged[def.Name]; !exists {
+			names = append(names, def.Name)
+		}
+		merged[def.Name] = def
+	}
+	if err := checkDefinitions(merged, names); err != nil {
+		return err
+	}
+	l.defs = merged
+	l.names = names
+	return nil
+}
+
+// checkDefinitions verifies that defs calls its own functions with the correct
+// number of arguments, and that there are no recursive dependencies.
+func checkDefinitions(defs map[string]*definition, names []string) error {
+	var err error
+	deps := make(map[string][]string, len(defs))
+	for _, name := range names {
+		def := defs[name]
+		bound := make(map[string]bool, len(def.Params))
+		for _, param := range def.Params {
+			bound[param] = true
+		}
+		references(def.Body, func(ref string, call bool, span Span) {
+			if bound[ref] {
+				return
+			}
+			if _, ok := defs[ref]; ok {
+				deps[name] = append(deps[name], ref)
+			}
+		})
+		walkNodes(def.Body, func(n node) {
+			c, ok := n.(*callNode)
+			if !ok || bound[c.Name] {
+				return
+			}
+			if callee, ok := defs[c.Name]; ok && len(callee.Params) != len(c.Args) && err == nil {
+				err = errors.New("exprel: " + name + " calls " + c.Name + " with " + strconv.Itoa(len(c.Args)) + " arguments, expecting " + strconv.Itoa(len(callee.Params)))
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(defs))
+	var path []string
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			for i, current := range path {
+				if current == name {
+					return errors.New("exprel: recursive definition " + strings.Join(append(path[i:], name), " -> "))
+				}
+			}
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		path = append(path, name)
+		for _, dep := range deps[name] {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = visited
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Names returns the names of the functions in the library, in declaration
+// order.
+func (l *Library) Names() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return append([]string(nil), l.names...)
+}
+
+// Get implements Source.
+func (l *Library) Get(ctx context.Context, name string) (interface{}, bool) {
+	l.mu.RLock()
+	def, ok := l.defs[name]
+	l.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	params := make([]Param, len(def.Params))
+	for i, param := range def.Params {
+		params[i] = Param{Name: param, Type: TypeAny}
+	}
+	fn := Func(func(c *Call) (interface{}, error) {
+		ctx := enterCall(c.Context())
+		var scope Source = l
+		if ev := evaluationFrom(ctx); ev != nil && ev.source != nil {
+			scope = Sources{l, ev.source}
+		}
+		for i, name := range def.Params {
+			scope = &localSource{
+				Name:   name,
+				Value:  c.Values[i],
+				Parent: scope,
+			}
+		}
+		defer func() {
+			if rec := recover(); rec != nil {
+				if err, ok := rec.(*RuntimeError); ok {
+					// the location is within the definition, rather than the
+					// expression being evaluated; the location of the call is
+					// used instead
+					err.Span = Span{}
+				}
+				panic(rec)
+			}
+		}()
+		return evaluate(ctx, def.Body, scope), nil
+	})
+	return &FuncDef{
+		Name:    def.Name,
+		Params:  params,
+		Returns: TypeAny,
+		Func:    fn,
+		lib:     l,
+		def:     def,
+	}, true
+}
+
+// MarshalText implements encoding.TextMarshaler. Each function declaration is
+// written on its own line.
+func (l *Library) MarshalText() ([]byte, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	b := newEncoder(ParseOptions{})
+	for _, name := range l.names {
+		def := l.defs[name]
+		b.WriteString(def.Name)
+		b.WriteByte('(')
+		for i, param := range def.Params {
+			if i > 0 {
+				b.writeSep()
+			}
+			b.WriteString(param)
+		}
+		b.WriteString(") := ")
+		def.Body.Encode(b)
+		b.WriteByte('\n')
+	}
+	return b.Bytes(), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. The existing functions in
+// the library are replaced with those declared in text.
+func (l *Library) UnmarshalText(text []byte) error {
+	var lib Library
+	if err := lib.Define(string(text)); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.defs = lib.defs
+	l.names = lib.names
+	l.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,189 @@
+package exprel
+
+// Locale maps the localized names of built-ins and functions to their
+// canonical (English) names.
+//
+// Expressions parsed with ParseOptions.Locale may call functions using either
+// their localized or canonical names; calls are stored using canonical names.
+// ParseOptions.Format writes the localized names of calls.
+type Locale struct {
+	Name string
+
+	canonical map[string]string
+	localized map[string]string
+}
+
+// NewLocale returns a new Locale. names maps localized names to canonical
+// names; both should be uppercase.
+func NewLocale(name string, names map[string]string) *Locale {
+	l := &Locale{
+		Name:      name,
+		canonical: make(map[string]string, len(names)),
+		localized: make(map[string]string, len(names)),
+	}
+	for local, canonical := range names {
+		l.canonical[local] = canonical
+		l.localized[canonical] = local
+	}
+	return l
+}
+
+// Canonical returns the canonical name of the localized function name. If name
+// is not localized, it is returned unchanged.
+func (l *Locale) Canonical(name string) string {
+	if l == nil {
+		return name
+	}
+	if canonical, ok := l.canonical[name]; ok {
+		return canonical
+	}
+	return name
+}
+
+// Localized returns the localized name of the canonical function name. If name
+// has no localized name, it is returned unchanged.
+func (l *Locale) Localized(name string) string {
+	if l == nil {
+		return name
+	}
+	if local, ok := l.localized[name]; ok {
+		return local
+	}
+	return name
+}
+
+// Locales for the built-ins and the functions defined in Base. Names that are
+// not translated (e.g. ABS, LET) are the same in the locale.
+var (
+	// LocaleDE is the German locale.
+	LocaleDE = NewLocale("de", map[string]string{
+		"WENN":        "IF",
+		"WAHR":        "TRUE",
+		"FALSCH":      "FALSE",
+		"UND":         "AND",
+		"ODER":        "OR",
+		"NICHT":       "NOT",
+		"WENNS":       "IFS",
+		"ERSTERWERT":  "SWITCH",
+		"XODER":       "XOR",
+		"WAHL":        "CHOOSE",
+		"TYP":         "TYPE",
+		"ZUFALLSZAHL": "RAND",
+		"JETZT":       "NOW",
+		"HEUTE":       "TODAY",
+		"VORZEICHEN":  "SIGN",
+		"ZEICHEN":     "CHAR",
+		"LINKS":       "LEFT",
+		"LÄNGE":       "LEN",
+		"KLEIN":       "LOWER",
+		"TEIL":        "MID",
+		"WIEDERHOLEN": "REPT",
+		"RECHTS":      "RIGHT",
+		"SUCHEN":      "SEARCH",
+		"GLÄTTEN":     "TRIM",
+		"GROSS":       "UPPER",
+		"DM":          "DOLLAR",
+		"FEST":        "FIXED",
+		"ZAHLENWERT":  "NUMBERVALUE",
+		"WERT":        "VALUE",
+	})
+
+	// LocaleFR is the French locale.
+	LocaleFR = NewLocale("fr", map[string]string{
+		"SI":            "IF",
+		"VRAI":          "TRUE",
+		"FAUX":          "FALSE",
+		"ET":            "AND",
+		"OU":            "OR",
+		"NON":           "NOT",
+		"SI.CONDITIONS": "IFS",
+		"SI.MULTIPLE":   "SWITCH",
+		"OUX":           "XOR",
+		"CHOISIR":       "CHOOSE",
+		"ALEA":          "RAND",
+		"MAINTENANT":    "NOW",
+		"AUJOURDHUI":    "TODAY",
+		"SIGNE":         "SIGN",
+		"CAR":           "CHAR",
+		"GAUCHE":        "LEFT",
+		"NBCAR":         "LEN",
+		"MINUSCULE":     "LOWER",
+		"STXT":          "MID",
+		"DROITE":        "RIGHT",
+		"CHERCHE":       "SEARCH",
+		"SUPPRESPACE":   "TRIM",
+		"MAJUSCULE":     "UPPER",
+		"EURO":          "DOLLAR",
+		"CTXT":          "FIXED",
+		"VALEURNOMBRE":  "NUMBERVALUE",
+		"TEXTE":         "TEXT",
+		"CNUM":          "VALUE",
+	})
+
+	// LocaleES is the Spanish locale.
+	LocaleES = NewLocale("es", map[string]string{
+		"SI":           "IF",
+		"VERDADERO":    "TRUE",
+		"FALSO":        "FALSE",
+		"Y":            "AND",
+		"O":            "OR",
+		"NO":           "NOT",
+		"SI.CONJUNTO":  "IFS",
+		"CAMBIAR":      "SWITCH",
+		"XO":           "XOR",
+		"ELEGIR":       "CHOOSE",
+		"TIPO":         "TYPE",
+		"ALEATORIO":    "RAND",
+		"AHORA":        "NOW",
+		"HOY":          "TODAY",
+		"SIGNO":        "SIGN",
+		"CARACTER":     "CHAR",
+		"IZQUIERDA":    "LEFT",
+		"LARGO":        "LEN",
+		"MINUSC":       "LOWER",
+		"EXTRAE":       "MID",
+		"REPETIR":      "REPT",
+		"DERECHA":      "RIGHT",
+		"HALLAR":       "SEARCH",
+		"ESPACIOS":     "TRIM",
+		"MAYUSC":       "UPPER",
+		"MONEDA":       "DOLLAR",
+		"DECIMAL":      "FIXED",
+		"VALOR.NUMERO": "NUMBERVALUE",
+		"TEXTO":        "TEXT",
+		"VALOR":        "VALUE",
+	})
+
+	// LocalePT is the Portuguese locale.
+	LocalePT = NewLocale("pt", map[string]string{
+		"SE":            "IF",
+		"VERDADEIRO":    "TRUE",
+		"FALSO":         "FALSE",
+		"E":             "AND",
+		"OU":            "OR",
+		"NÃO":           "NOT",
+		"SES":           "IFS",
+		"PARÂMETRO":     "SWITCH",
+		"OUEXCL":        "XOR",
+		"ESCOLHER":      "CHOOSE",
+		"TIPO":          "TYPE",
+		"ALEATÓRIO":     "RAND",
+		"AGORA":         "NOW",
+		"HOJE":          "TODAY",
+		"SINAL":         "SIGN",
+		"CARACT":        "CHAR",
+		"ESQUERDA":      "LEFT",
+		"NÚM.CARACT":    "LEN",
+		"MINÚSCULA":     "LOWER",
+		"EXT.TEXTO":     "MID",
+		"DIREITA":       "RIGHT",
+		"LOCALIZAR":     "SEARCH",
+		"ARRUMAR":       "TRIM",
+		"MAIÚSCULA":     "UPPER",
+		"MOEDA":         "DOLLAR",
+		"DEF.NÚM.DEC":   "FIXED",
+		"VALORNUMÉRICO": "NUMBERVALUE",
+		"TEXTO":         "TEXT",
+		"VALOR":         "VALUE",
+	})
+)
@@ -5,175 +5,440 @@ import (
 	"context"
 	"math"
 	"strconv"
+	"strings"
 )
 
 type node interface {
 	Evaluate(ctx context.Context, s Source) interface{}
-	Encode(b *bytes.Buffer)
+	Encode(b *encoder)
+	span() Span
 }
 
-type stringNode string
+// evaluate evaluates n. If n panics with a *RuntimeError that has no location,
+// the error is given the location of n.
+func evaluate(ctx context.Context, n node, s Source) interface{} {
+	ev := evaluationFrom(ctx)
+	if ev != nil && ev.hook != nil {
+		return ev.evaluateHooked(ctx, n, s)
+	}
+	return evaluateNode(ctx, ev, n, s)
+}
+
+func evaluateNode(ctx context.Context, ev *evaluation, n node, s Source) interface{} {
+	defer func() {
+		if rec := recover(); rec != nil {
+			if err, ok := rec.(*RuntimeError); ok && err.Span == (Span{}) {
+				err.Span = n.span()
+			}
+			panic(rec)
+		}
+	}()
+	ev.step()
+	return n.Evaluate(ctx, s)
+}
+
+// encoder writes the textual form of an expression.
+type encoder struct {
+	bytes.Buffer
+	sep     rune
+	decimal rune
+	locale  *Locale
+	// separators of array columns and rows
+	column, row rune
+	// names bound by enclosing LET and LAMBDA expressions
+	scope []string
+
+	// explain is true if the values of a trace are written after arguments
+	explain bool
+	// trace is the evaluation of the node being encoded, or nil if it was not
+	// evaluated
+	trace *TraceNode
+	used  map[*TraceNode]bool
+}
+
+func newEncoder(opts ParseOptions) *encoder {
+	return &encoder{
+		sep:     opts.argumentSeparator(),
+		decimal: opts.decimalSeparator(),
+		column:  opts.arrayColumnSeparator(),
+		row:     opts.arrayRowSeparator(),
+		locale:  opts.Locale,
+	}
+}
+
+// writeName writes the name of a built-in or called function, localized unless
+// it refers to a name bound by LET or LAMBDA.
+func (b *encoder) writeName(name string) {
+	for _, bound := range b.scope {
+		if bound == name {
+			b.WriteString(name)
+			return
+		}
+	}
+	b.WriteString(b.locale.Localized(name))
+}
+
+// writeSep writes an argument separator.
+func (b *encoder) writeSep() {
+	b.WriteRune(b.sep)
+	b.WriteByte(' ')
+}
 
-func (n stringNode) Evaluate(ctx context.Context, s Source) interface{} {
-	return string(n)
+// encode writes n, a child of the node being encoded.
+func (b *encoder) encode(n node) {
+	if !b.explain {
+		n.Encode(b)
+		return
+	}
+	parent := b.trace
+	b.trace = b.traced(n)
+	n.Encode(b)
+	b.trace = parent
+}
+
+// writeArg writes n, an argument of the call or built-in being encoded. When
+// explaining a trace, the argument is followed by its value.
+func (b *encoder) writeArg(n node) {
+	if !b.explain {
+		n.Encode(b)
+		return
+	}
+	parent := b.trace
+	t := b.traced(n)
+	b.trace = t
+	n.Encode(b)
+	b.trace = parent
+	if parent != nil {
+		b.writeResult(t)
+	}
+}
+
+// traced returns the first unused evaluation of n that is a child of the
+// current trace node, or nil if n was not evaluated.
+func (b *encoder) traced(n node) *TraceNode {
+	if b.trace == nil {
+		return nil
+	}
+	for _, child := range b.trace.Children {
+		if child.node == n && !b.used[child] {
+			b.used[child] = true
+			return child
+		}
+	}
+	return nil
 }
 
-func (n stringNode) Encode(b *bytes.Buffer) {
-	b.WriteString(strconv.Quote(string(n)))
+// writeArraySep writes an array column or row separator. Separators that are
+// also used between arguments are followed by a space; others are surrounded
+// by spaces.
+func (b *encoder) writeArraySep(sep rune) {
+	if sep != ';' && sep != ',' {
+		b.WriteByte(' ')
+	}
+	b.WriteRune(sep)
+	b.WriteByte(' ')
 }
 
-type boolNode bool
+type stringNode struct {
+	Span
+	Value string
+}
 
-func (n boolNode) Evaluate(ctx context.Context, s Source) interface{} {
-	return bool(n)
+func (n *stringNode) Evaluate(ctx context.Context, s Source) interface{} {
+	return n.Value
 }
 
-func (n boolNode) Encode(b *bytes.Buffer) {
-	if n {
-		b.WriteString("TRUE()")
+func (n *stringNode) Encode(b *encoder) {
+	b.WriteString(strconv.Quote(n.Value))
+}
+
+type boolNode struct {
+	Span
+	Value bool
+}
+
+func (n *boolNode) Evaluate(ctx context.Context, s Source) interface{} {
+	return n.Value
+}
+
+func (n *boolNode) Encode(b *encoder) {
+	if n.Value {
+		b.writeName("TRUE")
+		b.WriteString("()")
 	} else {
-		b.WriteString("FALSE()")
+		b.writeName("FALSE")
+		b.WriteString("()")
 	}
 }
 
-type numberNode float64
+type numberNode struct {
+	Span
+	Value float64
+}
+
+func (n *numberNode) Evaluate(ctx context.Context, s Source) interface{} {
+	return n.Value
+}
+
+func (n *numberNode) Encode(b *encoder) {
+	str := strconv.FormatFloat(n.Value, 'f', -1, 64)
+	if b.decimal != '.' {
+		str = strings.Replace(str, ".", string(b.decimal), 1)
+	}
+	b.WriteString(str)
+}
 
-func (n numberNode) Evaluate(ctx context.Context, s Source) interface{} {
-	return float64(n)
+type arrayNode struct {
+	Span
+	Rows [][]node
 }
 
-func (n numberNode) Encode(b *bytes.Buffer) {
-	b.WriteString(strconv.FormatFloat(float64(n), 'f', -1, 64))
+func (n *arrayNode) Evaluate(ctx context.Context, s Source) interface{} {
+	checkArraySize(ctx, len(n.Rows)*len(n.Rows[0]))
+	a := make(Array, len(n.Rows))
+	for i, row := range n.Rows {
+		a[i] = make([]interface{}, len(row))
+		for j, element := range row {
+			value := evaluate(ctx, element, s)
+			if _, ok := value.(Array); ok {
+				panic(&RuntimeError{Message: "array cannot contain an array", Kind: ErrTypeMismatch, Span: element.span()})
+			}
+			a[i][j] = value
+		}
+	}
+	return a
+}
+
+func (n *arrayNode) Encode(b *encoder) {
+	b.WriteByte('{')
+	for i, row := range n.Rows {
+		if i > 0 {
+			b.writeArraySep(b.row)
+		}
+		for j, element := range row {
+			if j > 0 {
+				b.writeArraySep(b.column)
+			}
+			b.encode(element)
+		}
+	}
+	b.WriteByte('}')
 }
 
 type notNode struct {
-	node
+	Span
+	Operand node
 }
 
 func (n *notNode) Evaluate(ctx context.Context, s Source) interface{} {
-	val, ok := n.node.Evaluate(ctx, s).(bool)
+	val, ok := evaluate(ctx, n.Operand, s).(bool)
 	if !ok {
-		panic(&RuntimeError{Message: "NOT expects bool value"})
+		panic(&RuntimeError{Message: "NOT expects bool value", Function: "NOT", Kind: ErrTypeMismatch})
 	}
 	return !val
 }
 
-func (n *notNode) Encode(b *bytes.Buffer) {
-	b.WriteString("NOT(")
-	n.node.Encode(b)
+func (n *notNode) Encode(b *encoder) {
+	b.writeName("NOT")
+	b.WriteByte('(')
+	b.writeArg(n.Operand)
 	b.WriteByte(')')
 }
 
-type lookupNode string
+type lookupNode struct {
+	Span
+	Name string
+}
 
-func (n lookupNode) Evaluate(ctx context.Context, s Source) interface{} {
-	id := string(n)
-	ret, ok := s.Get(ctx, id)
+func (n *lookupNode) Evaluate(ctx context.Context, s Source) interface{} {
+	id := n.Name
+	ret, ok := resolve(ctx, s, id)
 	select {
 	case <-ctx.Done():
-		panic(&RuntimeError{Err: ctx.Err()})
+		panic(&RuntimeError{Err: ctx.Err(), Kind: ErrCanceled})
 	default:
 	}
 	if !ok {
-		panic(&RuntimeError{Message: "unknown identifier " + id})
+		suggestions := suggest(s, id)
+		panic(&RuntimeError{
+			Message:     "unknown identifier " + id + didYouMean(suggestions),
+			Kind:        ErrUnknownIdentifier,
+			Suggestions: suggestions,
+		})
 	}
-	switch ret.(type) {
-	case string, bool, float64:
-	default:
-		panic(&RuntimeError{Message: "identifier '" + id + "' has invalid type"})
+	value, err := Normalize(ret)
+	if err != nil {
+		panic(&RuntimeError{Message: "identifier '" + id + "' has invalid type: " + err.Error(), Kind: ErrTypeMismatch})
+	}
+	return value
+}
+
+func (n *lookupNode) Encode(b *encoder) {
+	b.WriteString(n.Name)
+}
+
+// resolve returns the value of the identifier name from s. If s does not
+// contain name, but contains a prefix of name that ends before a dot, the rest
+// of name is looked up in the fields of the prefix's value, which must be a
+// Record. Longer prefixes are tried first.
+func resolve(ctx context.Context, s Source, name string) (interface{}, bool) {
+	if value, ok := s.Get(ctx, name); ok {
+		return value, true
 	}
-	return ret
+	for i := strings.LastIndexByte(name, '.'); i > 0; i = strings.LastIndexByte(name[:i], '.') {
+		if value, ok := s.Get(ctx, name[:i]); ok {
+			return field(value, name[i+1:])
+		}
+	}
+	return nil, false
 }
 
-func (n lookupNode) Encode(b *bytes.Buffer) {
-	b.WriteString(string(n))
+// field returns the field of value at path, a dotted list of field names.
+func field(value interface{}, path string) (interface{}, bool) {
+	for _, name := range strings.Split(path, ".") {
+		normalized, err := Normalize(value)
+		if err != nil {
+			return nil, false
+		}
+		record, ok := normalized.(Record)
+		if !ok {
+			return nil, false
+		}
+		if value, ok = record[name]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
 }
 
 type callNode struct {
+	Span
 	Name string
 	Args []node
 }
 
 func (n *callNode) Evaluate(ctx context.Context, s Source) interface{} {
 	name := n.Name
-	fnValue, ok := s.Get(ctx, name)
+	fnValue, ok := resolve(ctx, s, name)
 	select {
 	case <-ctx.Done():
-		panic(&RuntimeError{Err: ctx.Err()})
+		panic(&RuntimeError{Err: ctx.Err(), Kind: ErrCanceled})
 	default:
 	}
 
 	if !ok {
-		panic(&RuntimeError{Message: "unknown function " + name})
+		suggestions := suggest(s, name)
+		panic(&RuntimeError{
+			Message:     "unknown function " + name + didYouMean(suggestions),
+			Kind:        ErrUnknownFunction,
+			Suggestions: suggestions,
+		})
+	}
+	if normalized, err := Normalize(fnValue); err == nil {
+		fnValue = normalized
 	}
 	fn, ok := fnValue.(Func)
 	if !ok {
-		panic(&RuntimeError{Message: "cannot call non-function " + name})
+		panic(&RuntimeError{Message: "cannot call non-function " + name, Kind: ErrTypeMismatch})
+	}
+	return call(ctx, s, n.Span, name, fn, n.Args)
+}
+
+// call evaluates args and invokes fn with them. If fn fails, the name and
+// location of the call are added to the *RuntimeError.
+func call(ctx context.Context, s Source, span Span, name string, fn Func, args []node) interface{} {
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		values[i] = evaluate(ctx, arg, s)
 	}
+	return invoke(ctx, span, name, fn, values)
+}
+
+// invoke calls fn with values. If fn fails, the name and location of the call
+// are added to the *RuntimeError.
+func invoke(ctx context.Context, span Span, name string, fn Func, values []interface{}) interface{} {
 	call := Call{
 		Name:   name,
-		Values: make([]interface{}, len(n.Args)),
+		Values: values,
 
 		ctx: ctx,
 	}
-	for i, arg := range n.Args {
-		call.Values[i] = arg.Evaluate(ctx, s)
-	}
+	defer func() {
+		if rec := recover(); rec != nil {
+			if err, ok := recoveredError(rec); ok {
+				err.enter(span, name)
+				panic(err)
+			}
+			panic(rec)
+		}
+	}()
+	evaluationFrom(ctx).call()
 	ret, err := fn(&call)
 	if err != nil {
-		panic(&RuntimeError{Err: err})
+		panic(&RuntimeError{Err: err, Kind: ErrFunction})
 	}
-	switch ret.(type) {
-	case string, bool, float64:
-		return ret
-	default:
-		panic(&RuntimeError{Message: "invalid function return type"})
+	value, err := Normalize(ret)
+	if err != nil {
+		panic(&RuntimeError{Message: "invalid function return type: " + name + " returned " + err.Error(), Kind: ErrTypeMismatch})
+	}
+	switch v := value.(type) {
+	case string:
+		checkStringLength(ctx, len(v))
+	case Array:
+		checkArraySize(ctx, v.Rows()*v.Columns())
 	}
+	return value
 }
 
-func (n *callNode) Encode(b *bytes.Buffer) {
-	b.WriteString(n.Name)
+func (n *callNode) Encode(b *encoder) {
+	b.writeName(n.Name)
 	b.WriteByte('(')
 	for i, arg := range n.Args {
 		if i > 0 {
-			b.WriteString("; ")
+			b.writeSep()
 		}
-		arg.Encode(b)
+		b.writeArg(arg)
 	}
 	b.WriteByte(')')
 }
 
-type concatNode [2]node
+type concatNode struct {
+	Span
+	LHS node
+	RHS node
+}
 
-func (n concatNode) Evaluate(ctx context.Context, s Source) interface{} {
-	lhs, lhsOk := n[0].Evaluate(ctx, s).(string)
+func (n *concatNode) Evaluate(ctx context.Context, s Source) interface{} {
+	lhs, lhsOk := evaluate(ctx, n.LHS, s).(string)
 	if !lhsOk {
-		panic(&RuntimeError{Message: "LHS of & must be string"})
+		panic(&RuntimeError{Message: "LHS of & must be string", Kind: ErrTypeMismatch})
 	}
-	rhs, rhsOk := n[1].Evaluate(ctx, s).(string)
+	rhs, rhsOk := evaluate(ctx, n.RHS, s).(string)
 	if !rhsOk {
-		panic(&RuntimeError{Message: "RHS of & must be string"})
+		panic(&RuntimeError{Message: "RHS of & must be string", Kind: ErrTypeMismatch})
 	}
+	checkStringLength(ctx, len(lhs)+len(rhs))
 	return lhs + rhs
 }
 
-func (n concatNode) Encode(b *bytes.Buffer) {
-	n[0].Encode(b)
+func (n *concatNode) Encode(b *encoder) {
+	encodeOperand(b, n, n.LHS, true)
 	b.WriteString(" & ")
-	n[1].Encode(b)
+	encodeOperand(b, n, n.RHS, false)
 }
 
 type mathNode struct {
+	Span
 	Op  rune
 	LHS node
 	RHS node
 }
 
 func (n *mathNode) Evaluate(ctx context.Context, s Source) interface{} {
-	lhs, lhsOK := n.LHS.Evaluate(ctx, s).(float64)
-	rhs, rhsOK := n.RHS.Evaluate(ctx, s).(float64)
+	lhs, lhsOK := evaluate(ctx, n.LHS, s).(float64)
+	rhs, rhsOK := evaluate(ctx, n.RHS, s).(float64)
 	if !lhsOK || !rhsOK {
-		panic(&RuntimeError{Message: "invalid " + string(n.Op) + " operands"})
+		panic(&RuntimeError{Message: "invalid " + string(n.Op) + " operands", Kind: ErrTypeMismatch})
 	}
 	switch n.Op {
 	case tknAdd:
@@ -184,7 +449,7 @@ func (n *mathNode) Evaluate(ctx context.Context, s Source) interface{} {
 		return lhs * rhs
 	case tknDivide:
 		if rhs == 0 {
-			panic(&RuntimeError{Message: "attempted division by zero"})
+			panic(&RuntimeError{Message: "attempted division by zero", Kind: ErrDivisionByZero})
 		}
 		return lhs / rhs
 	case tknPower:
@@ -196,73 +461,72 @@ func (n *mathNode) Evaluate(ctx context.Context, s Source) interface{} {
 	}
 }
 
-func (n *mathNode) Encode(b *bytes.Buffer) {
-	n.LHS.Encode(b)
+func (n *mathNode) Encode(b *encoder) {
+	encodeOperand(b, n, n.LHS, true)
 	b.WriteByte(' ')
 	b.WriteRune(n.Op)
 	b.WriteByte(' ')
-	n.RHS.Encode(b)
+	encodeOperand(b, n, n.RHS, false)
 }
 
 type eqNode struct {
+	Span
 	Op  rune
 	LHS node
 	RHS node
 }
 
 func (n *eqNode) Evaluate(ctx context.Context, s Source) interface{} {
-	lhs := n.LHS.Evaluate(ctx, s)
-	rhs := n.RHS.Evaluate(ctx, s)
-	{
-		a, aOK := lhs.(string)
-		b, bOK := rhs.(string)
-		if aOK && bOK {
-			if n.Op == tknEquals {
-				return a == b
-			}
-			return a != b
-		}
+	lhs := evaluate(ctx, n.LHS, s)
+	rhs := evaluate(ctx, n.RHS, s)
+	equal, ok := valuesEqual(lhs, rhs)
+	if !ok {
+		panic(&RuntimeError{Message: "mismatched comparison operand types", Kind: ErrTypeMismatch})
 	}
-	{
-		a, aOK := lhs.(bool)
-		b, bOK := rhs.(bool)
-		if aOK && bOK {
-			if n.Op == tknEquals {
-				return a == b
-			}
-			return a != b
-		}
+	if n.Op == tknEquals {
+		return equal
 	}
-	{
-		a, aOK := lhs.(float64)
-		b, bOK := rhs.(float64)
-		if aOK && bOK {
-			if n.Op == tknEquals {
-				return a == b
-			}
-			return a != b
+	return !equal
+}
+
+// valuesEqual reports whether a and b are equal. ok is false if a and b are
+// not of the same type.
+func valuesEqual(a, b interface{}) (equal bool, ok bool) {
+	switch a := a.(type) {
+	case string:
+		if b, ok := b.(string); ok {
+			return a == b, true
+		}
+	case bool:
+		if b, ok := b.(bool); ok {
+			return a == b, true
+		}
+	case float64:
+		if b, ok := b.(float64); ok {
+			return a == b, true
 		}
 	}
-	panic(&RuntimeError{Message: "mismatched comparison operand types"})
+	return false, false
 }
 
-func (n *eqNode) Encode(b *bytes.Buffer) {
-	n.LHS.Encode(b)
+func (n *eqNode) Encode(b *encoder) {
+	encodeOperand(b, n, n.LHS, true)
 	b.WriteByte(' ')
 	b.WriteRune(n.Op)
 	b.WriteByte(' ')
-	n.RHS.Encode(b)
+	encodeOperand(b, n, n.RHS, false)
 }
 
 type cmpNode struct {
+	Span
 	Op  rune
 	LHS node
 	RHS node
 }
 
 func (n *cmpNode) Evaluate(ctx context.Context, s Source) interface{} {
-	lhs := n.LHS.Evaluate(ctx, s)
-	rhs := n.RHS.Evaluate(ctx, s)
+	lhs := evaluate(ctx, n.LHS, s)
+	rhs := evaluate(ctx, n.RHS, s)
 	{
 		a, aOK := lhs.(string)
 		b, bOK := rhs.(string)
@@ -295,11 +559,11 @@ func (n *cmpNode) Evaluate(ctx context.Context, s Source) interface{} {
 			}
 		}
 	}
-	panic(&RuntimeError{Message: "mismatched comparison operand types"})
+	panic(&RuntimeError{Message: "mismatched comparison operand types", Kind: ErrTypeMismatch})
 }
 
-func (n *cmpNode) Encode(b *bytes.Buffer) {
-	n.LHS.Encode(b)
+func (n *cmpNode) Encode(b *encoder) {
+	encodeOperand(b, n, n.LHS, true)
 	b.WriteByte(' ')
 	switch n.Op {
 	case tknGreaterEqual:
@@ -312,16 +576,53 @@ func (n *cmpNode) Encode(b *bytes.Buffer) {
 		b.WriteRune(n.Op)
 	}
 	b.WriteByte(' ')
-	n.RHS.Encode(b)
+	encodeOperand(b, n, n.RHS, false)
+}
+
+// precedence returns the binding strength of a binary operator node, or 0 if n
+// is not a binary operator.
+func precedence(n node) int {
+	switch n := n.(type) {
+	case *eqNode, *cmpNode:
+		return 1
+	case *concatNode:
+		return 2
+	case *mathNode:
+		switch n.Op {
+		case tknAdd, tknSubtract:
+			return 2
+		default:
+			return 3
+		}
+	default:
+		return 0
+	}
+}
+
+// encodeOperand encodes the operand of the binary operator parent,
+// parenthesizing it if required to preserve the structure of the expression.
+// Binary operators are right-associative.
+func encodeOperand(b *encoder, parent, operand node, lhs bool) {
+	prec := precedence(operand)
+	if prec > 0 && (prec < precedence(parent) || prec == precedence(parent) && lhs) {
+		b.WriteByte('(')
+		b.encode(operand)
+		b.WriteByte(')')
+		return
+	}
+	b.encode(operand)
 }
 
-type andNode []node
+type andNode struct {
+	Span
+	Operands []node
+}
 
-func (n andNode) Evaluate(ctx context.Context, s Source) interface{} {
-	for _, current := range n {
-		value, ok := current.Evaluate(ctx, s).(bool)
+func (n *andNode) Evaluate(ctx context.Context, s Source) interface{} {
+	for _, current := range n.Operands {
+		value, ok := evaluate(ctx, current, s).(bool)
 		if !ok {
-			panic(&RuntimeError{Message: "AND must have boolean arguments"})
+			panic(&RuntimeError{Message: "AND must have boolean arguments", Function: "AND", Kind: ErrTypeMismatch})
 		}
 		if !value {
 			return false
@@ -330,24 +631,28 @@ func (n andNode) Evaluate(ctx context.Context, s Source) interface{} {
 	return true
 }
 
-func (n andNode) Encode(b *bytes.Buffer) {
-	b.WriteString("AND(")
-	for i, operand := range n {
+func (n *andNode) Encode(b *encoder) {
+	b.writeName("AND")
+	b.WriteByte('(')
+	for i, operand := range n.Operands {
 		if i > 0 {
-			b.WriteString("; ")
+			b.writeSep()
 		}
-		operand.Encode(b)
+		b.writeArg(operand)
 	}
 	b.WriteByte(')')
 }
 
-type orNode []node
+type orNode struct {
+	Span
+	Operands []node
+}
 
-func (n orNode) Evaluate(ctx context.Context, s Source) interface{} {
-	for _, current := range n {
-		value, ok := current.Evaluate(ctx, s).(bool)
+func (n *orNode) Evaluate(ctx context.Context, s Source) interface{} {
+	for _, current := range n.Operands {
+		value, ok := evaluate(ctx, current, s).(bool)
 		if !ok {
-			panic(&RuntimeError{Message: "OR must have boolean arguments"})
+			panic(&RuntimeError{Message: "OR must have boolean arguments", Function: "OR", Kind: ErrTypeMismatch})
 		}
 		if value {
 			return true
@@ -356,40 +661,314 @@ func (n orNode) Evaluate(ctx context.Context, s Source) interface{} {
 	return false
 }
 
-func (n orNode) Encode(b *bytes.Buffer) {
-	b.WriteString("OR(")
-	for i, operand := range n {
+func (n *orNode) Encode(b *encoder) {
+	b.writeName("OR")
+	b.WriteByte('(')
+	for i, operand := range n.Operands {
 		if i > 0 {
-			b.WriteString("; ")
+			b.writeSep()
 		}
-		operand.Encode(b)
+		b.writeArg(operand)
 	}
 	b.WriteByte(')')
 }
 
 type ifNode struct {
+	Span
 	Cond  node
 	True  node
 	False node
 }
 
 func (n *ifNode) Evaluate(ctx context.Context, s Source) interface{} {
-	cond, ok := n.Cond.Evaluate(ctx, s).(bool)
+	cond, ok := evaluate(ctx, n.Cond, s).(bool)
 	if !ok {
-		panic(&RuntimeError{Message: "IF condition must be boolean"})
+		panic(&RuntimeError{Message: "IF condition must be boolean", Function: "IF", Kind: ErrTypeMismatch})
 	}
 	if cond {
-		return n.True.Evaluate(ctx, s)
+		return evaluate(ctx, n.True, s)
+	}
+	return evaluate(ctx, n.False, s)
+}
+
+func (n *ifNode) Encode(b *encoder) {
+	b.writeName("IF")
+	b.WriteByte('(')
+	b.writeArg(n.Cond)
+	b.writeSep()
+	b.writeArg(n.True)
+	b.writeSep()
+	b.writeArg(n.False)
+	b.WriteByte(')')
+}
+
+type ifsNode struct {
+	Span
+	Operands []node
+}
+
+func (n *ifsNode) Evaluate(ctx context.Context, s Source) interface{} {
+	for i := 0; i < len(n.Operands); i += 2 {
+		cond, ok := evaluate(ctx, n.Operands[i], s).(bool)
+		if !ok {
+			panic(&RuntimeError{Message: "IFS conditions must be boolean", Function: "IFS", Kind: ErrTypeMismatch})
+		}
+		if cond {
+			return evaluate(ctx, n.Operands[i+1], s)
+		}
+	}
+	panic(&RuntimeError{Message: "IFS has no true condition", Function: "IFS", Kind: ErrNoMatch})
+}
+
+func (n *ifsNode) Encode(b *encoder) {
+	b.writeName("IFS")
+	b.WriteByte('(')
+	for i, operand := range n.Operands {
+		if i > 0 {
+			b.writeSep()
+		}
+		b.writeArg(operand)
+	}
+	b.WriteByte(')')
+}
+
+type switchNode struct {
+	Span
+	Value   node
+	Cases   []node
+	Results []node
+	Default node
+}
+
+func (n *switchNode) Evaluate(ctx context.Context, s Source) interface{} {
+	value := evaluate(ctx, n.Value, s)
+	for i, c := range n.Cases {
+		if equal, _ := valuesEqual(value, evaluate(ctx, c, s)); equal {
+			return evaluate(ctx, n.Results[i], s)
+		}
+	}
+	if n.Default == nil {
+		panic(&RuntimeError{Message: "SWITCH has no matching value", Function: "SWITCH", Kind: ErrNoMatch})
+	}
+	return evaluate(ctx, n.Default, s)
+}
+
+func (n *switchNode) Encode(b *encoder) {
+	b.writeName("SWITCH")
+	b.WriteByte('(')
+	b.writeArg(n.Value)
+	for i, c := range n.Cases {
+		b.writeSep()
+		b.writeArg(c)
+		b.writeSep()
+		b.writeArg(n.Results[i])
+	}
+	if n.Default != nil {
+		b.writeSep()
+		b.writeArg(n.Default)
+	}
+	b.WriteByte(')')
+}
+
+type xorNode struct {
+	Span
+	Operands []node
+}
+
+func (n *xorNode) Evaluate(ctx context.Context, s Source) interface{} {
+	result := false
+	for _, current := range n.Operands {
+		value, ok := evaluate(ctx, current, s).(bool)
+		if !ok {
+			panic(&RuntimeError{Message: "XOR must have boolean arguments", Function: "XOR", Kind: ErrTypeMismatch})
+		}
+		result = result != value
+	}
+	return result
+}
+
+func (n *xorNode) Encode(b *encoder) {
+	b.writeName("XOR")
+	b.WriteByte('(')
+	for i, operand := range n.Operands {
+		if i > 0 {
+			b.writeSep()
+		}
+		b.writeArg(operand)
+	}
+	b.WriteByte(')')
+}
+
+type letNode struct {
+	Span
+	Names  []string
+	Values []node
+	Body   node
+}
+
+func (n *letNode) Evaluate(ctx context.Context, s Source) interface{} {
+	for i, name := range n.Names {
+		s = &localSource{
+			Name:   name,
+			Value:  evaluate(ctx, n.Values[i], s),
+			Parent: s,
+		}
+	}
+	return evaluate(ctx, n.Body, s)
+}
+
+func (n *letNode) Encode(b *encoder) {
+	b.writeName("LET")
+	b.WriteByte('(')
+	mark := len(b.scope)
+	for i, name := range n.Names {
+		b.WriteString(name)
+		b.writeSep()
+		b.writeArg(n.Values[i])
+		b.writeSep()
+		b.scope = append(b.scope, name)
+	}
+	b.writeArg(n.Body)
+	b.WriteByte(')')
+	b.scope = b.scope[:mark]
+}
+
+// localSource is a Source that binds a single name, deferring all other
+// lookups to its parent. The bound name hides the dotted identifiers that
+// begin with it, which refer to the fields of its value.
+type localSource struct {
+	Name   string
+	Value  interface{}
+	Parent Source
+}
+
+func (l *localSource) Get(ctx context.Context, name string) (interface{}, bool) {
+	if name == l.Name {
+		return l.Value, true
+	}
+	if strings.HasPrefix(name, l.Name) && name[len(l.Name)] == '.' {
+		return field(l.Value, name[len(l.Name)+1:])
+	}
+	if l.Parent == nil {
+		return nil, false
 	}
-	return n.False.Evaluate(ctx, s)
+	return l.Parent.Get(ctx, name)
+}
+
+// Names implements EnumerableSource.
+func (l *localSource) Names() []string {
+	return append([]string{l.Name}, sourceNames(l.Parent)...)
+}
+
+type lambdaNode struct {
+	Span
+	Params []string
+	Body   node
 }
 
-func (n *ifNode) Encode(b *bytes.Buffer) {
-	b.WriteString("IF(")
-	n.Cond.Encode(b)
-	b.WriteString("; ")
-	n.True.Encode(b)
-	b.WriteString("; ")
-	n.False.Encode(b)
+func (n *lambdaNode) Evaluate(ctx context.Context, s Source) interface{} {
+	return Func(func(c *Call) (interface{}, error) {
+		if len(c.Values) != len(n.Params) {
+			panic(&RuntimeError{Message: c.Name + " expects " + strconv.Itoa(len(n.Params)) + " arguments", Kind: ErrArgumentCount})
+		}
+		ctx := enterCall(c.Context())
+		scope := s
+		for i, name := range n.Params {
+			scope = &localSource{
+				Name:   name,
+				Value:  c.Values[i],
+				Parent: scope,
+			}
+		}
+		return evaluate(ctx, n.Body, scope), nil
+	})
+}
+
+func (n *lambdaNode) Encode(b *encoder) {
+	b.writeName("LAMBDA")
+	b.WriteByte('(')
+	mark := len(b.scope)
+	for _, name := range n.Params {
+		b.WriteString(name)
+		b.writeSep()
+		b.scope = append(b.scope, name)
+	}
+	b.encode(n.Body)
 	b.WriteByte(')')
+	b.scope = b.scope[:mark]
+}
+
+type invokeNode struct {
+	Span
+	Fn   node
+	Args []node
+}
+
+func (n *invokeNode) Evaluate(ctx context.Context, s Source) interface{} {
+	fn, ok := evaluate(ctx, n.Fn, s).(Func)
+	if !ok {
+		panic(&RuntimeError{Message: "cannot call non-function value", Kind: ErrTypeMismatch})
+	}
+	return call(ctx, s, n.Span, "LAMBDA", fn, n.Args)
+}
+
+func (n *invokeNode) Encode(b *encoder) {
+	switch n.Fn.(type) {
+	case *lambdaNode, *callNode, *invokeNode:
+		b.encode(n.Fn)
+	default:
+		b.WriteByte('(')
+		b.encode(n.Fn)
+		b.WriteByte(')')
+	}
+	b.WriteByte('(')
+	for i, arg := range n.Args {
+		if i > 0 {
+			b.writeSep()
+		}
+		b.writeArg(arg)
+	}
+	b.WriteByte(')')
+}
+
+// errorNode is a part of an expression that could not be parsed.
+type errorNode struct {
+	Span
+	Err *SyntaxError
+	// Text is the source of the node.
+	Text string
+}
+
+func (n *errorNode) Evaluate(ctx context.Context, s Source) interface{} {
+	panic(&RuntimeError{Message: "invalid expression: " + n.Err.Message, Kind: ErrInvalidExpression})
+}
+
+func (n *errorNode) Encode(b *encoder) {
+	b.WriteString(n.Text)
+}
+
+type contextKey int
+
+const (
+	callDepthKey contextKey = iota
+	evaluationKey
+	seedKey
+	clockKey
+	hookKey
+)
+
+// enterCall returns a context for evaluating the body of a user-defined
+// function. It panics with a *RuntimeError if ctx has been canceled or if the
+// maximum call depth has been reached.
+func enterCall(ctx context.Context) context.Context {
+	select {
+	case <-ctx.Done():
+		panic(&RuntimeError{Err: ctx.Err(), Kind: ErrCanceled})
+	default:
+	}
+	depth, _ := ctx.Value(callDepthKey).(int)
+	if depth+1 >= evaluationFrom(ctx).maxCallDepth() {
+		panic(&RuntimeError{Message: "maximum call depth reached", Kind: ErrLimitExceeded})
+	}
+	return context.WithValue(ctx, callDepthKey, depth+1)
 }
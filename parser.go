@@ -1,22 +1,49 @@
 package exprel
 
+import (
+	"strconv"
+	"strings"
+)
+
 const maximumDepth = 1024
 
 type parser struct {
 	Node node
 
-	depth   int
-	l       *lexer
+	depth int
+	l     *lexer
+	opts  ParseOptions
+	// the token returned by the next call to next, if peeked is true. If the
+	// lexer failed to read the token, lastErr is set.
 	lastTkn interface{}
+	lastErr *SyntaxError
+	peeked  bool
+	// positions of the last token returned by next, and of lastTkn
+	start, end         int
+	lastStart, lastEnd int
+	// names bound by enclosing LET and LAMBDA expressions
+	scope []string
+	// number of unclosed parentheses and braces returned by next
+	parens int
+
+	// if recovering is true, syntax errors are recorded in errs, rather than
+	// aborting the parse
+	recovering bool
+	errs       []*SyntaxError
+	src        string
 }
 
-func parseString(s string) (n node, err error) {
+// parseString parses the expression s, which must begin with '='.
+func parseString(s string, opts ParseOptions) (n node, err error) {
 	p := &parser{
-		l: newLexer(s),
+		l:    newLexer(s[1:], opts),
+		opts: opts,
 	}
+	p.l.Offset = 1
 	defer func() {
 		if rec := recover(); rec != nil {
 			if syntaxErr, ok := rec.(*SyntaxError); ok {
+				syntaxErr.locate(s)
 				err = syntaxErr
 				return
 			}
@@ -27,6 +54,43 @@ func parseString(s string) (n node, err error) {
 	return
 }
 
+// parseRecover is like parseString, but continues parsing after syntax errors.
+// The parts of s that could not be parsed are represented by *errorNode.
+func parseRecover(s string, opts ParseOptions) (node, []*SyntaxError) {
+	p := &parser{
+		l:          newLexer(s[1:], opts),
+		opts:       opts,
+		recovering: true,
+		src:        s,
+	}
+	p.l.Offset = 1
+	n := p.parseProgram()
+	for _, err := range p.errs {
+		err.locate(s)
+	}
+	return n, p.errs
+}
+
+func parseDefinitions(s string) (defs []*definition, err error) {
+	p := &parser{
+		l: newLexer(s, ParseOptions{}),
+	}
+	defer func() {
+		if rec := recover(); rec != nil {
+			if syntaxErr, ok := rec.(*SyntaxError); ok {
+				syntaxErr.locate(s)
+				err = syntaxErr
+				return
+			}
+			panic(rec)
+		}
+	}()
+	for p.peek() != nil || p.lastErr != nil {
+		defs = append(defs, p.parseDefinition())
+	}
+	return
+}
+
 func (p *parser) do(fn func() node) node {
 	p.depth++
 	if p.depth >= maximumDepth {
@@ -43,31 +107,81 @@ func (p *parser) do(fn func() node) node {
 	return n
 }
 
+// bound returns the spelling of name as it was bound by an enclosing LET or
+// LAMBDA expression. If name refers to a field of a bound name (e.g.
+// order.total), the bound name is respelled.
+func (p *parser) bound(name string) (string, bool) {
+	same := func(a, b string) bool {
+		return a == b || p.opts.CaseInsensitive && strings.EqualFold(a, b)
+	}
+	for i := len(p.scope) - 1; i >= 0; i-- {
+		bound := p.scope[i]
+		if same(bound, name) {
+			return bound, true
+		}
+		if len(name) > len(bound) && name[len(bound)] == '.' && same(bound, name[:len(bound)]) {
+			return bound + name[len(bound):], true
+		}
+	}
+	return "", false
+}
+
 func (p *parser) next() interface{} {
-	if p.lastTkn != nil {
-		tkn := p.lastTkn
-		p.lastTkn = nil
-		return tkn
+	tkn := p.peek()
+	if p.lastErr != nil {
+		panic(p.lastErr)
+	}
+	p.peeked = false
+	p.lastTkn = nil
+	p.start, p.end = p.lastStart, p.lastEnd
+	switch tkn {
+	case tknOpen, tknArrayOpen:
+		p.parens++
+	case tknClose, tknArrayClose:
+		p.parens--
 	}
-	return p.l.Next()
+	return tkn
 }
 
-func (p *parser) nextRune(expecting rune) {
-	r, ok := p.next().(rune)
-	if !ok || r != expecting {
-		panic(&SyntaxError{
-			Message:  "expecting '" + string(expecting) + "'",
-			Position: p.l.pos(),
-		})
+// expect reads the next token, which must be one of the given runes.
+func (p *parser) expect(expected ...rune) rune {
+	if r, ok := p.peek().(rune); ok {
+		for _, e := range expected {
+			if r == e {
+				p.next()
+				return r
+			}
+		}
+	}
+	descriptions := make([]string, len(expected))
+	for i, e := range expected {
+		descriptions[i] = p.describe(e)
 	}
+	panic(p.unexpected(descriptions...))
 }
 
+// span returns the span from start to the end of the last token returned by
+// next.
+func (p *parser) span(start int) Span {
+	return Span{start, p.end}
+}
+
+// peek returns the token that will be returned by the next call to next. nil
+// is returned at EOF, or if the token is invalid.
 func (p *parser) peek() interface{} {
-	if p.lastTkn != nil {
+	if p.peeked {
 		return p.lastTkn
 	}
+	p.peeked = true
 	defer func() {
-		recover()
+		p.lastStart, p.lastEnd = p.l.Start, p.l.pos()
+		if rec := recover(); rec != nil {
+			syntaxErr, ok := rec.(*SyntaxError)
+			if !ok {
+				panic(rec)
+			}
+			p.lastErr = syntaxErr
+		}
 	}()
 	p.lastTkn = p.l.Next()
 	return p.lastTkn
@@ -80,20 +194,207 @@ func (p *parser) peekRune(expecting rune) bool {
 	return false
 }
 
+// unexpected returns an error for the token returned by peek, which is not
+// valid. expected describes the tokens that are valid. If the token could not
+// be read, the lexer's error is returned instead.
+func (p *parser) unexpected(expected ...string) *SyntaxError {
+	tkn := p.peek()
+	if p.lastErr != nil {
+		return p.lastErr
+	}
+	message := "unexpected "
+	switch v := tkn.(type) {
+	case nil:
+		message += "EOF"
+	case rune:
+		message += p.describe(v)
+	case identifier:
+		message += "identifier " + string(v)
+	case string:
+		message += "string " + strconv.Quote(v)
+	case float64:
+		message += "number " + strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	if len(expected) > 0 {
+		message += ", expecting "
+		for i, e := range expected {
+			if i > 0 {
+				if i == len(expected)-1 {
+					message += " or "
+				} else {
+					message += ", "
+				}
+			}
+			message += e
+		}
+	}
+	return &SyntaxError{
+		Message:  message,
+		Position: p.lastStart,
+		Expected: expected,
+	}
+}
+
+// describe returns the quoted source representation of the token r.
+func (p *parser) describe(r rune) string {
+	switch r {
+	case tknSep:
+		r = p.l.Sep
+	case tknColumn:
+		r = p.l.Column
+	case tknRow:
+		r = p.l.Row
+	case tknGreaterEqual:
+		return "'>='"
+	case tknLessEqual:
+		return "'<='"
+	case tknInequal:
+		return "'<>'"
+	case tknDefine:
+		return "':='"
+	}
+	return "'" + string(r) + "'"
+}
+
 /*
  * PROGRAM     EXPRESSION
  */
 func (p *parser) parseProgram() node {
+	if p.recovering {
+		return p.parseOperand()
+	}
 	expr := p.do(p.parseExpression)
-	if p.l.HasNext() {
-		panic(&SyntaxError{
-			Message:  "expecting EOF",
-			Position: p.l.pos(),
-		})
+	if p.peek() != nil || p.lastErr != nil {
+		panic(p.unexpected("EOF"))
 	}
 	return expr
 }
 
+// parseOperand parses an expression that is followed by ';' or ')' (or EOF,
+// at the top level).
+//
+// When recovering, a syntax error in the expression is recorded, the tokens up
+// to the next ';' or ')' at the same nesting level are skipped, and an
+// *errorNode is returned.
+func (p *parser) parseOperand() (n node) {
+	if !p.recovering {
+		return p.do(p.parseExpression)
+	}
+
+	depth, scope, parens := p.depth, len(p.scope), p.parens
+	p.peek()
+	start := p.lastStart
+	top := depth == 0
+	defer func() {
+		if rec := recover(); rec != nil {
+			syntaxErr, ok := rec.(*SyntaxError)
+			if !ok {
+				panic(rec)
+			}
+			p.depth, p.scope = depth, p.scope[:scope]
+			p.record(syntaxErr)
+			p.skip(parens, top)
+			end := p.end
+			if end < start {
+				// nothing was consumed
+				end = start
+			}
+			n = &errorNode{
+				Span: Span{start, end},
+				Err:  syntaxErr,
+				Text: p.src[start:end],
+			}
+		}
+	}()
+
+	n = p.do(p.parseExpression)
+	if top {
+		if p.peek() != nil || p.lastErr != nil {
+			panic(p.unexpected("EOF"))
+		}
+	} else if !p.peekRune(tknSep) && !p.peekRune(tknClose) {
+		panic(p.unexpected(p.describe(tknSep), p.describe(tknClose)))
+	}
+	return n
+}
+
+// record adds err to the list of syntax errors, unless an error has already
+// been recorded at the same position.
+func (p *parser) record(err *SyntaxError) {
+	for _, existing := range p.errs {
+		if existing.Position == err.Position {
+			return
+		}
+	}
+	p.errs = append(p.errs, err)
+}
+
+// skip skips tokens until the next ';' or ')' outside of the parentheses and
+// braces opened since parens were open, or EOF if top is true.
+func (p *parser) skip(parens int, top bool) {
+	for {
+		tkn := p.peek()
+		if p.lastErr != nil {
+			// skip past the invalid token
+			p.record(p.lastErr)
+			p.lastErr = nil
+			p.peeked = false
+			p.end = p.lastEnd
+			continue
+		}
+		if tkn == nil {
+			return
+		}
+		if !top && p.parens <= parens && (tkn == tknSep || tkn == tknClose) {
+			return
+		}
+		p.next()
+	}
+}
+
+/*
+ * DEFINITION  IDENTIFIER "(" ( IDENTIFIER ( ";" IDENTIFIER )* )? ")" ":=" EXPRESSION
+ */
+func (p *parser) parseDefinition() *definition {
+	name, ok := p.peek().(identifier)
+	if !ok {
+		panic(p.unexpected("function name"))
+	}
+	p.next()
+	def := &definition{
+		Name: string(name),
+	}
+	p.expect(tknOpen)
+	if !p.peekRune(tknClose) {
+		for {
+			param, ok := p.peek().(identifier)
+			if !ok {
+				panic(p.unexpected("parameter name"))
+			}
+			p.next()
+			for _, existing := range def.Params {
+				if existing == string(param) {
+					panic(&SyntaxError{
+						Message:  "duplicate parameter " + existing,
+						Position: p.start,
+					})
+				}
+			}
+			def.Params = append(def.Params, string(param))
+			p.scope = append(p.scope, string(param))
+			if p.expect(tknSep, tknClose) == tknClose {
+				break
+			}
+		}
+	} else {
+		p.next()
+	}
+	p.expect(tknDefine)
+	def.Body = p.do(p.parseExpression)
+	p.scope = p.scope[:0]
+	return def
+}
+
 /*
  * EXPRESSION: BIN1 ["=" | ">" | ">=" | "<" | "<=" | "<>" ] EXPRESSION
  *             BIN1
@@ -105,11 +406,11 @@ func (p *parser) parseExpression() node {
 		case tknEquals, tknInequal:
 			p.next()
 			rhs := p.do(p.parseExpression)
-			return &eqNode{r, lhs, rhs}
+			return &eqNode{Span{lhs.span().Start, rhs.span().End}, r, lhs, rhs}
 		case tknGreater, tknGreaterEqual, tknLess, tknLessEqual:
 			p.next()
 			rhs := p.do(p.parseExpression)
-			return &cmpNode{r, lhs, rhs}
+			return &cmpNode{Span{lhs.span().Start, rhs.span().End}, r, lhs, rhs}
 		}
 	}
 	return lhs
@@ -126,33 +427,51 @@ func (p *parser) parseBin1() node {
 		case tknAdd, tknSubtract:
 			p.next()
 			rhs := p.do(p.parseBin1)
-			return &mathNode{r, lhs, rhs}
+			return &mathNode{Span{lhs.span().Start, rhs.span().End}, r, lhs, rhs}
 		case tknConcat:
 			p.next()
 			rhs := p.do(p.parseBin1)
-			return concatNode{lhs, rhs}
+			return &concatNode{Span{lhs.span().Start, rhs.span().End}, lhs, rhs}
 		}
 	}
 	return lhs
 }
 
 /*
- * BIN2        TERM
- *             TERM ["*" | "/" | "^" | "%" ] BIN2
+ * BIN2        POSTFIX
+ *             POSTFIX ["*" | "/" | "^" | "%" ] BIN2
  */
 func (p *parser) parseBin2() node {
-	lhs := p.do(p.parseTerm)
+	lhs := p.do(p.parsePostfix)
 	if r, ok := p.peek().(rune); ok {
 		switch r {
 		case tknMultiply, tknDivide, tknPower, tknModulo:
 			p.next()
 			rhs := p.do(p.parseBin2)
-			return &mathNode{r, lhs, rhs}
+			return &mathNode{Span{lhs.span().Start, rhs.span().End}, r, lhs, rhs}
 		}
 	}
 	return lhs
 }
 
+/*
+ * POSTFIX     TERM ( "(" (EXPRESSION ( ";" EXPRESSION )*)? ")" )*
+ */
+func (p *parser) parsePostfix() node {
+	n := p.do(p.parseTerm)
+	for p.peekRune(tknOpen) {
+		p.next()
+		fn := n
+		args := p.parseArgs()
+		n = &invokeNode{
+			Span: Span{fn.span().Start, p.end},
+			Fn:   fn,
+			Args: args,
+		}
+	}
+	return n
+}
+
 /*
  * TERM        "(" EXPRESSION ")"
  *             "IF" "(" EXPRESSION ";" EXPRESSION ";" EXPRESSION" ")"
@@ -163,116 +482,300 @@ func (p *parser) parseBin2() node {
  *             "AND" "(" EXPRESSION ( ";" EXPRESSION )* ")"
  *             "OR" "(" EXPRESSION ( ";" EXPRESSION )* ")"
  *             "NOT" "(" EXPRESSION ")"
+ *             "IFS" "(" EXPRESSION ";" EXPRESSION ( ";" EXPRESSION ";" EXPRESSION )* ")"
+ *             "SWITCH" "(" EXPRESSION ( ";" EXPRESSION ";" EXPRESSION )+ ( ";" EXPRESSION )? ")"
+ *             "XOR" "(" EXPRESSION ( ";" EXPRESSION )* ")"
+ *             "LET" "(" ( IDENTIFIER ";" EXPRESSION ";" )+ EXPRESSION ")"
+ *             "LAMBDA" "(" ( IDENTIFIER ";" )* EXPRESSION ")"
  *             "-" NUMBER
+ *             "{" EXPRESSION ( ( COLUMN | ROW ) EXPRESSION )* "}"
  *             IDENTIFIER "(" (EXPRESSION ( ";" EXPRESSION )*)? ")"
  *             IDENTIFIER
  */
 func (p *parser) parseTerm() node {
-	tkn := p.next()
+	tkn := p.peek()
+	if r, ok := tkn.(rune); tkn == nil || ok && r != tknOpen && r != tknSubtract && r != tknArrayOpen {
+		panic(p.unexpected("expression"))
+	}
+	p.next()
+	start := p.start
 
 	switch v := tkn.(type) {
 	case rune:
 		switch v {
 		case tknOpen:
-			expr := p.do(p.parseExpression)
-			p.nextRune(tknClose)
+			expr := p.parseOperand()
+			p.expect(tknClose)
 			return expr
 		case tknSubtract:
-			num, ok := p.next().(float64)
+			num, ok := p.peek().(float64)
 			if !ok {
-				panic(&SyntaxError{
-					Message:  "expecting number",
-					Position: p.l.pos(),
-				})
+				panic(p.unexpected("number"))
 			}
-			return numberNode(-num)
+			p.next()
+			return &numberNode{p.span(start), -num}
+		case tknArrayOpen:
+			return p.parseArray(start)
 		default:
-			panic(&SyntaxError{
-				Message:  "unexpected '" + string(v) + "'",
-				Position: p.l.pos(),
-			})
+			panic("never triggered")
 		}
 	case identifier:
 		if p.peekRune(tknOpen) {
-			switch string(v) {
+			if name, ok := p.bound(string(v)); ok {
+				// call of a name bound by LET or LAMBDA
+				p.next()
+				args := p.parseArgs()
+				return &callNode{
+					Span: p.span(start),
+					Name: name,
+					Args: args,
+				}
+			}
+			name := string(v)
+			if p.opts.CaseInsensitive {
+				name = strings.ToUpper(name)
+			}
+			name = p.opts.Locale.Canonical(name)
+			switch name {
 			case "IF":
 				p.next()
-				ifCond := p.do(p.parseExpression)
-				p.nextRune(tknSep)
-				ifTrue := p.do(p.parseExpression)
-				p.nextRune(tknSep)
-				ifFalse := p.do(p.parseExpression)
-				p.nextRune(tknClose)
-				return &ifNode{ifCond, ifTrue, ifFalse}
+				ifCond := p.parseOperand()
+				p.expect(tknSep)
+				ifTrue := p.parseOperand()
+				p.expect(tknSep)
+				ifFalse := p.parseOperand()
+				p.expect(tknClose)
+				return &ifNode{p.span(start), ifCond, ifTrue, ifFalse}
 			case "TRUE":
 				p.next()
-				p.nextRune(tknClose)
-				return boolNode(true)
+				p.expect(tknClose)
+				return &boolNode{p.span(start), true}
 			case "FALSE":
 				p.next()
-				p.nextRune(tknClose)
-				return boolNode(false)
+				p.expect(tknClose)
+				return &boolNode{p.span(start), false}
 			case "NOT":
 				p.next()
-				expr := p.do(p.parseExpression)
-				p.nextRune(tknClose)
-				return &notNode{expr}
+				expr := p.parseOperand()
+				p.expect(tknClose)
+				return &notNode{p.span(start), expr}
 			case "AND":
 				p.next()
-				var n andNode
+				n := &andNode{}
 				for {
-					expr := p.do(p.parseExpression)
-					n = append(n, expr)
-					if !p.peekRune(tknSep) {
+					expr := p.parseOperand()
+					n.Operands = append(n.Operands, expr)
+					if p.expect(tknSep, tknClose) == tknClose {
 						break
 					}
-					p.nextRune(tknSep)
 				}
-				p.nextRune(tknClose)
+				n.Span = p.span(start)
 				return n
 			case "OR":
 				p.next()
-				var n orNode
+				n := &orNode{}
 				for {
-					expr := p.do(p.parseExpression)
-					n = append(n, expr)
-					if !p.peekRune(tknSep) {
+					expr := p.parseOperand()
+					n.Operands = append(n.Operands, expr)
+					if p.expect(tknSep, tknClose) == tknClose {
 						break
 					}
-					p.nextRune(tknSep)
 				}
-				p.nextRune(tknClose)
+				n.Span = p.span(start)
 				return n
-			default:
+			case "IFS":
+				p.next()
+				args := p.parseList()
+				if len(args)%2 != 0 {
+					panic(&SyntaxError{
+						Message:  "IFS expects condition and value pairs",
+						Position: start,
+					})
+				}
+				return &ifsNode{p.span(start), args}
+			case "SWITCH":
 				p.next()
-				call := &callNode{
-					Name: string(v),
+				args := p.parseList()
+				if len(args) < 3 {
+					panic(&SyntaxError{
+						Message:  "SWITCH expects at least three arguments",
+						Position: start,
+					})
+				}
+				n := &switchNode{
+					Span:  p.span(start),
+					Value: args[0],
+				}
+				args = args[1:]
+				for len(args) >= 2 {
+					n.Cases = append(n.Cases, args[0])
+					n.Results = append(n.Results, args[1])
+					args = args[2:]
 				}
-				if !p.peekRune(tknClose) {
-					for {
-						expr := p.do(p.parseExpression)
-						call.Args = append(call.Args, expr)
-						if !p.peekRune(tknSep) {
+				if len(args) == 1 {
+					n.Default = args[0]
+				}
+				return n
+			case "XOR":
+				p.next()
+				args := p.parseList()
+				return &xorNode{p.span(start), args}
+			case "LET":
+				p.next()
+				mark := len(p.scope)
+				n := &letNode{}
+				for i := 0; ; i++ {
+					expr := p.parseOperand()
+					if i%2 == 0 && p.peekRune(tknClose) {
+						n.Body = expr
+						break
+					}
+					if i%2 == 0 {
+						if errNode, ok := expr.(*errorNode); ok {
+							panic(errNode.Err)
+						}
+						name, ok := expr.(*lookupNode)
+						if !ok {
+							panic(&SyntaxError{
+								Message:  "LET expects identifier",
+								Position: expr.span().Start,
+							})
+						}
+						n.Names = append(n.Names, name.Name)
+					} else {
+						if p.peekRune(tknClose) {
 							break
 						}
-						p.next()
+						n.Values = append(n.Values, expr)
+						// the name is visible to subsequent expressions
+						p.scope = append(p.scope, n.Names[len(n.Names)-1])
 					}
+					p.expect(tknSep)
+				}
+				if len(n.Names) == 0 || n.Body == nil {
+					panic(&SyntaxError{
+						Message:  "LET expects name and value pairs followed by an expression",
+						Position: start,
+					})
+				}
+				p.expect(tknClose)
+				p.scope = p.scope[:mark]
+				n.Span = p.span(start)
+				return n
+			case "LAMBDA":
+				p.next()
+				mark := len(p.scope)
+				n := &lambdaNode{}
+				for {
+					expr := p.parseOperand()
+					if p.expect(tknSep, tknClose) == tknClose {
+						n.Body = expr
+						break
+					}
+					if errNode, ok := expr.(*errorNode); ok {
+						panic(errNode.Err)
+					}
+					name, ok := expr.(*lookupNode)
+					if !ok {
+						panic(&SyntaxError{
+							Message:  "LAMBDA expects identifier",
+							Position: expr.span().Start,
+						})
+					}
+					for _, param := range n.Params {
+						if param == name.Name {
+							panic(&SyntaxError{
+								Message:  "duplicate LAMBDA parameter " + param,
+								Position: name.Span.Start,
+							})
+						}
+					}
+					n.Params = append(n.Params, name.Name)
+					p.scope = append(p.scope, name.Name)
+				}
+				p.scope = p.scope[:mark]
+				n.Span = p.span(start)
+				return n
+			default:
+				p.next()
+				args := p.parseArgs()
+				return &callNode{
+					Span: p.span(start),
+					Name: name,
+					Args: args,
 				}
-				p.nextRune(tknClose)
-				return call
 			}
 		}
-		return lookupNode(string(v))
+		if name, ok := p.bound(string(v)); ok {
+			return &lookupNode{p.span(start), name}
+		}
+		return &lookupNode{p.span(start), string(v)}
 	case bool:
-		return boolNode(v)
+		return &boolNode{p.span(start), v}
 	case string:
-		return stringNode(v)
+		return &stringNode{p.span(start), v}
 	case float64:
-		return numberNode(v)
+		return &numberNode{p.span(start), v}
 	default:
-		panic(&SyntaxError{
-			Message:  "expecting token",
-			Position: p.l.pos(),
-		})
+		panic("never triggered")
+	}
+}
+
+// parseArray parses the elements of an array literal, whose opening brace is
+// at start, followed by a closing brace.
+func (p *parser) parseArray(start int) node {
+	// a separator that is also the argument separator is read as tknSep
+	column, rowSep := rune(tknColumn), rune(tknRow)
+	switch p.l.Sep {
+	case p.l.Column:
+		column = tknSep
+	case p.l.Row:
+		rowSep = tknSep
+	}
+	n := &arrayNode{}
+	var row []node
+	for {
+		row = append(row, p.do(p.parseExpression))
+		sep := p.expect(column, rowSep, tknArrayClose)
+		if sep == column {
+			continue
+		}
+		if len(n.Rows) > 0 && len(row) != len(n.Rows[0]) {
+			panic(&SyntaxError{
+				Message:  "array rows must have the same number of columns",
+				Position: row[0].span().Start,
+			})
+		}
+		n.Rows = append(n.Rows, row)
+		row = nil
+		if sep == tknArrayClose {
+			break
+		}
+	}
+	n.Span = p.span(start)
+	return n
+}
+
+// parseList parses one or more ';' separated expressions, followed by a
+// closing parenthesis.
+func (p *parser) parseList() []node {
+	var list []node
+	for {
+		expr := p.parseOperand()
+		list = append(list, expr)
+		if p.expect(tknSep, tknClose) == tknClose {
+			break
+		}
+	}
+	return list
+}
+
+// parseArgs parses zero or more ';' separated expressions, followed by a
+// closing parenthesis.
+func (p *parser) parseArgs() []node {
+	if p.peekRune(tknClose) {
+		p.next()
+		return nil
 	}
+	return p.parseList()
 }
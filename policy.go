@@ -0,0 +1,162 @@
+package exprel
+
+import (
+	"context"
+)
+
+// Policy restricts the functions and identifiers that an expression may use.
+// Names are matched exactly. Built-ins, such as IF and LET, and names bound by
+// LET and LAMBDA are not subject to a Policy.
+//
+// A Policy is enforced statically by Check and ParseOptions.Policy, and during
+// evaluation by PolicySource, which also covers names that are not referenced
+// directly by the expression (e.g. names used by Library functions).
+type Policy struct {
+	// AllowFunctions, if non-nil, contains the only functions that may be
+	// called.
+	AllowFunctions []string
+	// DenyFunctions contains functions that may not be called.
+	DenyFunctions []string
+
+	// AllowIdentifiers, if non-nil, contains the only identifiers that may be
+	// referenced.
+	AllowIdentifiers []string
+	// DenyIdentifiers contains identifiers that may not be referenced.
+	DenyIdentifiers []string
+}
+
+// PolicyError is returned when an expression uses a function or identifier
+// that is not permitted by a Policy. During evaluation, it is the Err of a
+// *RuntimeError of kind ErrPolicyViolation.
+type PolicyError struct {
+	// Name is the function or identifier that is not permitted.
+	Name string
+	// Function is true if Name is a function.
+	Function bool
+	// Span is the location of the reference to Name. During evaluation, a
+	// reference made by the body of a Library function is located at the call
+	// in the evaluated expression that led to it, rather than in the function's
+	// definition. It is the zero Span if the location is unknown.
+	Span Span
+}
+
+func (e *PolicyError) Error() string {
+	if e.Function {
+		return "exprel: policy violation: function " + e.Name + " is not allowed"
+	}
+	return "exprel: policy violation: identifier " + e.Name + " is not allowed"
+}
+
+// Is reports whether target is ErrPolicyViolation.
+func (e *PolicyError) Is(target error) bool {
+	return target == error(ErrPolicyViolation)
+}
+
+// Allowed reports whether p permits the function or identifier name.
+func (p *Policy) Allowed(name string, function bool) bool {
+	if p == nil {
+		return true
+	}
+	allow, deny := p.AllowIdentifiers, p.DenyIdentifiers
+	if function {
+		allow, deny = p.AllowFunctions, p.DenyFunctions
+	}
+	if allow != nil && !containsName(allow, name) {
+		return false
+	}
+	return !containsName(deny, name)
+}
+
+// Check verifies that the functions called and identifiers referenced by e
+// are permitted by p. The first violation, in order of appearance, is
+// returned as a *PolicyError.
+//
+// Identifiers are also checked against the function rules, as they may refer
+// to functions that are called indirectly:
+//  - identifiers that are invoked, directly (e.g. =(RAND)()) or through a name
+//    bound by LET (e.g. =LET(f; RAND; f())), are checked as functions
+//  - identifiers that are denied by DenyFunctions are rejected
+// Functions that are passed as arguments to other functions are only checked
+// against AllowFunctions by PolicySource.
+func (p *Policy) Check(e *Expression) error {
+	var err error
+	references(e.node, func(name string, call bool, span Span) {
+		if err != nil {
+			return
+		}
+		switch {
+		case !call && p != nil && containsName(p.DenyFunctions, name):
+			err = &PolicyError{
+				Name:     name,
+				Function: true,
+				Span:     span,
+			}
+		case !p.Allowed(name, call):
+			err = &PolicyError{
+				Name:     name,
+				Function: call,
+				Span:     span,
+			}
+		}
+	})
+	return err
+}
+
+func containsName(names []string, name string) bool {
+	for _, current := range names {
+		if current == name {
+			return true
+		}
+	}
+	return false
+}
+
+// PolicySource returns a Source that wraps s and enforces p. Values of s that
+// are functions are checked against the function rules of p, and all other
+// values against the identifier rules. Looking up a name that is not permitted
+// fails with a *RuntimeError of kind ErrPolicyViolation. The fields of a Record
+// are permitted if the record is.
+func PolicySource(s Source, p *Policy) Source {
+	return &policySource{
+		Source: s,
+		Policy: p,
+	}
+}
+
+type policySource struct {
+	Source Source
+	Policy *Policy
+}
+
+func (s *policySource) Get(ctx context.Context, name string) (interface{}, bool) {
+	value, ok := s.Source.Get(ctx, name)
+	if !ok {
+		return nil, false
+	}
+	function := false
+	if normalized, err := Normalize(value); err == nil {
+		_, function = normalized.(Func)
+	}
+	if !s.Policy.Allowed(name, function) {
+		panic(&RuntimeError{
+			Err: &PolicyError{
+				Name:     name,
+				Function: function,
+			},
+			Kind: ErrPolicyViolation,
+		})
+	}
+	return value, true
+}
+
+// Names implements EnumerableSource. Names that are neither permitted as a
+// function nor as an identifier are omitted.
+func (s *policySource) Names() []string {
+	var names []string
+	for _, name := range sourceNames(s.Source) {
+		if s.Policy.Allowed(name, true) || s.Policy.Allowed(name, false) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,422 @@
+package exprel
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProfileKind is the kind of a ProfileEntry.
+type ProfileKind int
+
+// Kinds of ProfileEntry.
+const (
+	// ProfileExpression is an entry for the evaluation of an expression as a
+	// whole. The name of the entry is the textual form of the expression.
+	ProfileExpression ProfileKind = iota
+	// ProfileFunction is an entry for calls to a function. Calls to
+	// functions that are not named (e.g. LAMBDA(n; n * 2)(x)) are named
+	// LAMBDA.
+	ProfileFunction
+	// ProfileIdentifier is an entry for the lookup of an identifier in a
+	// Source.
+	ProfileIdentifier
+)
+
+func (k ProfileKind) String() string {
+	switch k {
+	case ProfileExpression:
+		return "expression"
+	case ProfileFunction:
+		return "function"
+	case ProfileIdentifier:
+		return "identifier"
+	default:
+		return "unknown"
+	}
+}
+
+// ProfileEntry contains the cost of an expression, function or identifier,
+// aggregated across evaluations.
+type ProfileEntry struct {
+	Kind ProfileKind
+	Name string
+	// Count is the number of evaluations, calls or lookups.
+	Count int64
+	// Total is the time spent, including the time spent in nested entries
+	// (e.g. the arguments of a function call). Nested recursive calls of a
+	// function are only counted once.
+	Total time.Duration
+	// Self is the time spent, excluding the time spent in nested entries.
+	Self time.Duration
+}
+
+// Profiler is a Hook that measures the time spent evaluating expressions,
+// calling functions and looking up identifiers. It is enabled for an
+// evaluation by passing it to WithHook:
+//  ctx = exprel.WithHook(ctx, profiler)
+//
+// Measurements are aggregated across all evaluations that use the Profiler.
+// A Profiler is safe for concurrent use. The zero value is an empty Profiler.
+type Profiler struct {
+	mu      sync.Mutex
+	entries map[profileKey]*ProfileEntry
+	samples map[string]*profileSample
+	stacks  map[*evaluation][]*profileFrame
+}
+
+type profileKey struct {
+	Kind ProfileKind
+	Name string
+}
+
+// profileFrame is an entry that is being measured.
+type profileFrame struct {
+	Key   profileKey
+	Start time.Time
+	// Nested is the time spent in nested frames.
+	Nested time.Duration
+	// Recursive is true if the frame's key is also used by an enclosing
+	// frame.
+	Recursive bool
+}
+
+// profileSample is the cost of a stack of entries, excluding the cost of
+// nested entries.
+type profileSample struct {
+	// Stack contains the keys of the entries, outermost first.
+	Stack []profileKey
+	Count int64
+	Self  time.Duration
+}
+
+// profileKeys returns the keys of the entries measured by step. Entries are
+// measured for the expression as a whole (the step at depth 0), function
+// calls and identifier lookups.
+func profileKeys(step *Step) []profileKey {
+	var keys []profileKey
+	if step.Depth == 0 {
+		keys = append(keys, profileKey{ProfileExpression, expressionText(step.node)})
+	}
+	switch n := step.node.(type) {
+	case *callNode:
+		keys = append(keys, profileKey{ProfileFunction, n.Name})
+	case *invokeNode:
+		keys = append(keys, profileKey{ProfileFunction, "LAMBDA"})
+	case *lookupNode:
+		keys = append(keys, profileKey{ProfileIdentifier, n.Name})
+	}
+	return keys
+}
+
+// profileFrames returns the number of keys returned by profileKeys.
+func profileFrames(step *Step) int {
+	frames := 0
+	if step.Depth == 0 {
+		frames++
+	}
+	switch step.node.(type) {
+	case *callNode, *invokeNode, *lookupNode:
+		frames++
+	}
+	return frames
+}
+
+// expressionText returns the textual form of the expression whose root is n.
+func expressionText(n node) string {
+	if str, ok := n.(*stringNode); ok && (len(str.Value) == 0 || str.Value[0] != '=') {
+		return str.Value
+	}
+	b := newEncoder(ParseOptions{})
+	b.WriteByte('=')
+	n.Encode(b)
+	return b.String()
+}
+
+// Before implements Hook.
+func (p *Profiler) Before(ctx context.Context, step *Step) {
+	keys := profileKeys(step)
+	ev := evaluationFrom(ctx)
+	if len(keys) == 0 || ev == nil {
+		return
+	}
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stacks == nil {
+		p.stacks = make(map[*evaluation][]*profileFrame)
+	}
+	stack := p.stacks[ev]
+	for _, key := range keys {
+		frame := &profileFrame{
+			Key:   key,
+			Start: now,
+		}
+		for _, enclosing := range stack {
+			if enclosing.Key == key {
+				frame.Recursive = true
+			}
+		}
+		stack = append(stack, frame)
+	}
+	p.stacks[ev] = stack
+}
+
+// After implements Hook.
+func (p *Profiler) After(ctx context.Context, step *Step) {
+	frames := profileFrames(step)
+	ev := evaluationFrom(ctx)
+	if frames == 0 || ev == nil {
+		return
+	}
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.entries == nil {
+		p.entries = make(map[profileKey]*ProfileEntry)
+		p.samples = make(map[string]*profileSample)
+	}
+	stack := p.stacks[ev]
+	for i := 0; i < frames; i++ {
+		if len(stack) == 0 {
+			break
+		}
+		frame := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		total := now.Sub(frame.Start)
+		self := total - frame.Nested
+		if len(stack) > 0 {
+			stack[len(stack)-1].Nested += total
+		}
+
+		entry := p.entries[frame.Key]
+		if entry == nil {
+			entry = &ProfileEntry{
+				Kind: frame.Key.Kind,
+				Name: frame.Key.Name,
+			}
+			p.entries[frame.Key] = entry
+		}
+		entry.Count++
+		entry.Self += self
+		if !frame.Recursive {
+			entry.Total += total
+		}
+
+		keys := make([]profileKey, 0, len(stack)+1)
+		for _, enclosing := range stack {
+			keys = append(keys, enclosing.Key)
+		}
+		keys = append(keys, frame.Key)
+		id := stackID(keys)
+		sample := p.samples[id]
+		if sample == nil {
+			sample = &profileSample{
+				Stack: keys,
+			}
+			p.samples[id] = sample
+		}
+		sample.Count++
+		sample.Self += self
+	}
+	if len(stack) == 0 {
+		delete(p.stacks, ev)
+	} else {
+		p.stacks[ev] = stack
+	}
+}
+
+// stackID returns a string that identifies a stack of keys.
+func stackID(keys []profileKey) string {
+	var b strings.Builder
+	for _, key := range keys {
+		b.WriteByte(byte('0' + key.Kind))
+		b.WriteString(key.Name)
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// Entries returns the measured expressions, functions and identifiers, in
+// order of decreasing total time.
+func (p *Profiler) Entries() []ProfileEntry {
+	p.mu.Lock()
+	entries := make([]ProfileEntry, 0, len(p.entries))
+	for _, entry := range p.entries {
+		entries = append(entries, *entry)
+	}
+	p.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Total != entries[j].Total {
+			return entries[i].Total > entries[j].Total
+		}
+		if entries[i].Kind != entries[j].Kind {
+			return entries[i].Kind < entries[j].Kind
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	return entries
+}
+
+// Reset discards all measurements.
+func (p *Profiler) Reset() {
+	p.mu.Lock()
+	p.entries = nil
+	p.samples = nil
+	p.mu.Unlock()
+}
+
+// WriteProfile writes the measurements to w as a gzip-compressed profile in
+// the format read by pprof (e.g. go tool pprof). Each sample has two values:
+// the number of calls, and the time spent in nanoseconds. Expressions,
+// functions and identifiers are written as functions; the names of
+// functions are followed by "()".
+func (p *Profiler) WriteProfile(w io.Writer) error {
+	p.mu.Lock()
+	samples := make([]profileSample, 0, len(p.samples))
+	for _, sample := range p.samples {
+		samples = append(samples, *sample)
+	}
+	p.mu.Unlock()
+	sort.Slice(samples, func(i, j int) bool {
+		return stackID(samples[i].Stack) < stackID(samples[j].Stack)
+	})
+
+	var b profileBuilder
+	b.strings = map[string]int64{"": 0}
+	b.table = []string{""}
+	b.functions = make(map[profileKey]uint64)
+
+	var profile protoBuffer
+	for _, valueType := range [][2]string{{"calls", "count"}, {"time", "nanoseconds"}} {
+		var vt protoBuffer
+		vt.int64(1, b.str(valueType[0]))
+		vt.int64(2, b.str(valueType[1]))
+		profile.message(1, &vt)
+	}
+	for _, sample := range samples {
+		var s protoBuffer
+		// locations are written leaf first
+		ids := make([]uint64, len(sample.Stack))
+		for i, key := range sample.Stack {
+			ids[len(ids)-1-i] = b.function(key)
+		}
+		s.packed(1, ids)
+		s.packed(2, []uint64{uint64(sample.Count), uint64(sample.Self.Nanoseconds())})
+		profile.message(2, &s)
+	}
+	for i, key := range b.order {
+		id := uint64(i + 1)
+		var line protoBuffer
+		line.uint64(1, id)
+		var location protoBuffer
+		location.uint64(1, id)
+		location.message(4, &line)
+		profile.message(4, &location)
+
+		var function protoBuffer
+		function.uint64(1, id)
+		function.int64(2, b.str(profileName(key)))
+		function.int64(3, b.str(profileName(key)))
+		function.int64(4, b.str(key.Kind.String()))
+		profile.message(5, &function)
+	}
+	var period protoBuffer
+	period.int64(1, b.str("time"))
+	period.int64(2, b.str("nanoseconds"))
+	profile.message(11, &period)
+	profile.int64(9, time.Now().UnixNano())
+	// fields may appear in any order, so the string table is written once
+	// all strings are known
+	for _, str := range b.table {
+		profile.bytes(6, []byte(str))
+	}
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(profile.Bytes()); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// profileName returns the name of the pprof function of key.
+func profileName(key profileKey) string {
+	if key.Kind == ProfileFunction {
+		return key.Name + "()"
+	}
+	return key.Name
+}
+
+// profileBuilder assigns the indexes of strings and the ids of functions in
+// a pprof profile.
+type profileBuilder struct {
+	strings   map[string]int64
+	table     []string
+	functions map[profileKey]uint64
+	order     []profileKey
+}
+
+func (b *profileBuilder) str(s string) int64 {
+	if i, ok := b.strings[s]; ok {
+		return i
+	}
+	i := int64(len(b.table))
+	b.strings[s] = i
+	b.table = append(b.table, s)
+	return i
+}
+
+func (b *profileBuilder) function(key profileKey) uint64 {
+	if id, ok := b.functions[key]; ok {
+		return id
+	}
+	b.order = append(b.order, key)
+	id := uint64(len(b.order))
+	b.functions[key] = id
+	return id
+}
+
+// protoBuffer encodes a protocol buffer message.
+type protoBuffer struct {
+	bytes.Buffer
+}
+
+func (b *protoBuffer) varint(x uint64) {
+	for x >= 0x80 {
+		b.WriteByte(byte(x) | 0x80)
+		x >>= 7
+	}
+	b.WriteByte(byte(x))
+}
+
+func (b *protoBuffer) uint64(field int, x uint64) {
+	b.varint(uint64(field) << 3)
+	b.varint(x)
+}
+
+func (b *protoBuffer) int64(field int, x int64) {
+	b.uint64(field, uint64(x))
+}
+
+func (b *protoBuffer) bytes(field int, data []byte) {
+	b.varint(uint64(field)<<3 | 2)
+	b.varint(uint64(len(data)))
+	b.Write(data)
+}
+
+func (b *protoBuffer) packed(field int, values []uint64) {
+	var data protoBuffer
+	for _, x := range values {
+		data.varint(x)
+	}
+	b.bytes(field, data.Bytes())
+}
+
+func (b *protoBuffer) message(field int, m *protoBuffer) {
+	b.bytes(field, m.Bytes())
+}
@@ -0,0 +1,231 @@
+package exprel
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// StructSource returns a Source that exposes the exported fields and methods of
+// v, which must be a struct or a pointer to a struct.
+//
+// Fields are identified by their name, or by the name given in an exprel
+// struct tag. Fields tagged with "-" are ignored. The fields of embedded
+// structs are promoted. Fields of nested structs are accessed using dotted
+// identifiers:
+//  type Order struct {
+//    ID       int    `exprel:"id"`
+//    Customer struct {
+//      Name string
+//    }
+//  }
+//  =Customer.Name & " #" & TEXT(id; "0")
+//
+// Field values are converted as described by Normalize.
+//
+// Methods that take no arguments (other than an optional context.Context) are
+// evaluated when their name is looked up. Other methods are returned as Funcs,
+// with their arguments converted as described by WrapFunc. If a method that is
+// evaluated on lookup returns a non-nil error, Get panics with a
+// *RuntimeError.
+//
+// The fields and methods of each struct type are computed once and cached.
+func StructSource(v interface{}) Source {
+	value := reflect.ValueOf(v)
+	switch {
+	case !value.IsValid():
+		panic("exprel: StructSource expects struct, got nil")
+	case value.Kind() == reflect.Ptr && value.IsNil():
+		panic("exprel: StructSource expects struct, got nil " + value.Type().String())
+	case value.Kind() == reflect.Ptr && value.Elem().Kind() == reflect.Struct:
+		return structSource{value}
+	}
+	if value.Kind() != reflect.Struct {
+		panic("exprel: StructSource expects struct, got " + value.Type().String())
+	}
+	// copy the struct so that methods with pointer receivers are accessible
+	ptr := reflect.New(value.Type())
+	ptr.Elem().Set(value)
+	return structSource{ptr}
+}
+
+type structSource struct {
+	V reflect.Value
+}
+
+// structPlan describes how the fields and methods of a type are accessed.
+type structPlan struct {
+	Fields  map[string][]int
+	Methods map[string]*methodPlan
+}
+
+type methodPlan struct {
+	Index   int
+	Value   bool
+	Wrapper *wrapper
+}
+
+// structPlans maps a reflect.Type to its *structPlan.
+var structPlans sync.Map
+
+// planFor returns the plan for t, which must be a struct or a pointer to a
+// struct.
+func planFor(t reflect.Type) *structPlan {
+	if plan, ok := structPlans.Load(t); ok {
+		return plan.(*structPlan)
+	}
+
+	plan := &structPlan{
+		Fields:  make(map[string][]int),
+		Methods: make(map[string]*methodPlan),
+	}
+	st := t
+	if st.Kind() == reflect.Ptr {
+		st = st.Elem()
+	}
+	addFields(plan, st, nil)
+
+	for i := 0; i < t.NumMethod(); i++ {
+		method := t.Method(i)
+		if method.PkgPath != "" {
+			continue
+		}
+		// drop the receiver from the method's type
+		in := make([]reflect.Type, method.Type.NumIn()-1)
+		for j := range in {
+			in[j] = method.Type.In(j + 1)
+		}
+		out := make([]reflect.Type, method.Type.NumOut())
+		for j := range out {
+			out[j] = method.Type.Out(j)
+		}
+		fnType := reflect.FuncOf(in, out, method.Type.IsVariadic())
+		w, err := newWrapper(fnType)
+		if err != "" {
+			continue
+		}
+		plan.Methods[method.Name] = &methodPlan{
+			Index:   i,
+			Value:   !w.hasCall && len(w.required) == 0 && len(w.optional) == 0 && w.variadic == nil,
+			Wrapper: w,
+		}
+	}
+
+	actual, _ := structPlans.LoadOrStore(t, plan)
+	return actual.(*structPlan)
+}
+
+func addFields(plan *structPlan, t reflect.Type, index []int) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Name
+		tag, hasTag := field.Tag.Lookup("exprel")
+		if tag == "-" {
+			continue
+		}
+		if tag != "" {
+			name = tag
+		}
+		fieldIndex := append(append([]int(nil), index...), i)
+		if field.Anonymous && !hasTag {
+			ft := field.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct && ft != timeType {
+				addFields(plan, ft, fieldIndex)
+				continue
+			}
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if _, exists := plan.Fields[name]; exists && len(index) > 0 {
+			// fields of the outer struct take precedence
+			continue
+		}
+		plan.Fields[name] = fieldIndex
+	}
+}
+
+// fieldByIndex is like reflect.Value.FieldByIndex, but returns false if a nil
+// embedded pointer is encountered.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// Get implements Source.
+func (s structSource) Get(ctx context.Context, name string) (interface{}, bool) {
+	v := s.V
+	for {
+		plan := planFor(v.Type())
+		head, rest := name, ""
+		if i := strings.IndexByte(name, '.'); i >= 0 {
+			head, rest = name[:i], name[i+1:]
+		}
+
+		if index, ok := plan.Fields[head]; ok {
+			field, ok := fieldByIndex(reflect.Indirect(v), index)
+			if !ok {
+				return nil, false
+			}
+			if rest == "" {
+				return field.Interface(), true
+			}
+			for field.Kind() == reflect.Ptr || field.Kind() == reflect.Interface {
+				if field.IsNil() {
+					return nil, false
+				}
+				field = field.Elem()
+			}
+			if field.Kind() != reflect.Struct {
+				return nil, false
+			}
+			if field.CanAddr() {
+				field = field.Addr()
+			}
+			v = field
+			name = rest
+			continue
+		}
+
+		method, ok := plan.Methods[head]
+		if !ok || rest != "" {
+			return nil, false
+		}
+		fn := v.Method(method.Index)
+		if method.Value {
+			value, err := method.Wrapper.call(fn, &Call{Name: name, ctx: ctx})
+			if err != nil {
+				panic(&RuntimeError{Err: err, Kind: ErrSource})
+			}
+			return value, true
+		}
+		return Func(func(c *Call) (interface{}, error) {
+			return method.Wrapper.call(fn, c)
+		}), true
+	}
+}
+
+// timeToSerial converts t to a spreadsheet serial date number, using the wall
+// clock time of t in its location.
+func timeToSerial(t time.Time) float64 {
+	year, month, day := t.Date()
+	date := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	days := float64(date.Sub(serialEpoch) / (24 * time.Hour))
+	clock := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second + time.Duration(t.Nanosecond())
+	return days + clock.Seconds()/86400
+}
@@ -0,0 +1,105 @@
+package exprel
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// maximumSuggestions is the maximum number of suggestions given for an
+// unknown name.
+const maximumSuggestions = 3
+
+// suggest returns the names of s that are similar to name, most similar
+// first. Names that differ only in case are the most similar, followed by
+// names with the smallest edit distance.
+func suggest(s Source, name string) []string {
+	names := sourceNames(s)
+	if len(names) == 0 {
+		return nil
+	}
+
+	type candidate struct {
+		Name     string
+		Distance int
+	}
+	folded := strings.ToUpper(name)
+	// allow roughly one edit for every three characters
+	maximum := utf8.RuneCountInString(name) / 3
+	if maximum < 1 {
+		maximum = 1
+	}
+	var candidates []candidate
+	for _, current := range names {
+		if current == name {
+			continue
+		}
+		distance := editDistance(folded, strings.ToUpper(current))
+		if distance == 0 {
+			// differs only in case
+			distance = -1
+		}
+		if distance <= maximum {
+			candidates = append(candidates, candidate{current, distance})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Distance != candidates[j].Distance {
+			return candidates[i].Distance < candidates[j].Distance
+		}
+		return candidates[i].Name < candidates[j].Name
+	})
+	if len(candidates) > maximumSuggestions {
+		candidates = candidates[:maximumSuggestions]
+	}
+	var suggestions []string
+	for _, c := range candidates {
+		suggestions = append(suggestions, c.Name)
+	}
+	return suggestions
+}
+
+// editDistance returns the Levenshtein distance between a and b, counted in
+// runes.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min3(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// didYouMean returns a suffix for an error message that lists suggestions.
+func didYouMean(suggestions []string) string {
+	switch len(suggestions) {
+	case 0:
+		return ""
+	case 1:
+		return " (did you mean " + suggestions[0] + "?)"
+	default:
+		return " (did you mean " + strings.Join(suggestions[:len(suggestions)-1], ", ") + " or " + suggestions[len(suggestions)-1] + "?)"
+	}
+}
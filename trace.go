@@ -0,0 +1,163 @@
+package exprel
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Trace is a record of the evaluation of an expression, as returned by
+// EvaluateTrace.
+type Trace struct {
+	// Root is the evaluation of the expression as a whole.
+	Root *TraceNode
+}
+
+// TraceNode is the record of the evaluation of a part of an expression.
+type TraceNode struct {
+	// Span is the location of the part in the expression's source.
+	Span Span
+	// Value is the result of the part. It is nil if the evaluation failed.
+	Value interface{}
+	// Err is the error that caused the evaluation to fail, if any.
+	Err *RuntimeError
+	// Duration is the time taken to evaluate the part, including its
+	// children.
+	Duration time.Duration
+	// Children contains the evaluations that were performed while evaluating
+	// the part, in order. Parts that were not evaluated, such as the branch of
+	// an IF that was not taken, are not included. A part may be evaluated more
+	// than once (e.g. the body of a function defined with LAMBDA).
+	Children []*TraceNode
+
+	node node
+}
+
+// EvaluateTrace is like EvaluateContext, but records the value and duration
+// of every part of the expression that is evaluated. The trace is returned
+// even if the evaluation fails.
+//
+// Tracing slows down evaluation considerably; it is intended for explaining
+// the result of an expression (see Trace.Explain).
+func (e *Expression) EvaluateTrace(ctx context.Context, s Source) (interface{}, *Trace, error) {
+	return EvalOptions{}.EvaluateTrace(ctx, e, s)
+}
+
+// EvaluateTrace is like Expression.EvaluateTrace, but evaluates e using the
+// options in o.
+func (o EvalOptions) EvaluateTrace(ctx context.Context, e *Expression, s Source) (interface{}, *Trace, error) {
+	tracer := &tracer{
+		stack: []*TraceNode{{}},
+	}
+	val, err := e.evaluate(ctx, s, &evaluation{opts: o, hook: tracer})
+	trace := &Trace{}
+	if top := tracer.stack[0]; len(top.Children) > 0 {
+		trace.Root = top.Children[0]
+	}
+	return val, trace, err
+}
+
+// tracer is a Hook that records a Trace.
+type tracer struct {
+	mu sync.Mutex
+	// stack contains the nodes being evaluated; the first is a placeholder
+	// whose child is the root of the trace
+	stack  []*TraceNode
+	starts []time.Time
+}
+
+func (t *tracer) Before(ctx context.Context, step *Step) {
+	n := &TraceNode{
+		Span: step.Span,
+		node: step.node,
+	}
+	t.mu.Lock()
+	parent := t.stack[len(t.stack)-1]
+	parent.Children = append(parent.Children, n)
+	t.stack = append(t.stack, n)
+	t.starts = append(t.starts, time.Now())
+	t.mu.Unlock()
+}
+
+func (t *tracer) After(ctx context.Context, step *Step) {
+	t.mu.Lock()
+	n := t.stack[len(t.stack)-1]
+	n.Duration = time.Since(t.starts[len(t.starts)-1])
+	n.Value = step.Value
+	n.Err = step.Err
+	t.stack = t.stack[:len(t.stack)-1]
+	t.starts = t.starts[:len(t.starts)-1]
+	t.mu.Unlock()
+}
+
+// Explain returns the expression annotated with the values of the arguments
+// of its function calls and built-ins, and with its result:
+//  AND(x > 5 → TRUE; y = "a" → FALSE) → FALSE
+// Arguments that were not evaluated (e.g. because of short-circuiting) are
+// marked as such:
+//  IF(x > 5 → FALSE; "big" → not evaluated; "small" → "small") → "small"
+func (t *Trace) Explain() string {
+	if t.Root == nil {
+		return ""
+	}
+	b := newEncoder(ParseOptions{})
+	b.explain = true
+	b.trace = t.Root
+	b.used = make(map[*TraceNode]bool)
+	t.Root.node.Encode(b)
+	b.writeResult(t.Root)
+	return b.String()
+}
+
+// String returns the result of Explain.
+func (t *Trace) String() string {
+	return t.Explain()
+}
+
+// writeResult writes the result of the traced node t, or a marker if t is nil.
+func (b *encoder) writeResult(t *TraceNode) {
+	b.WriteString(" → ")
+	switch {
+	case t == nil:
+		b.WriteString("not evaluated")
+	case t.Err != nil:
+		b.WriteString("error")
+	default:
+		b.writeValue(t.Value)
+	}
+}
+
+// writeValue writes an expression value in the form of a literal.
+func (b *encoder) writeValue(value interface{}) {
+	switch v := value.(type) {
+	case string:
+		b.WriteString(strconv.Quote(v))
+	case float64:
+		(&numberNode{Value: v}).Encode(b)
+	case bool:
+		if v {
+			b.WriteString("TRUE")
+		} else {
+			b.WriteString("FALSE")
+		}
+	case Func:
+		b.WriteString("function")
+	case Record:
+		b.WriteString("record")
+	case Array:
+		b.WriteByte('{')
+		for i, row := range v {
+			if i > 0 {
+				b.writeArraySep(b.row)
+			}
+			for j, element := range row {
+				if j > 0 {
+					b.writeArraySep(b.column)
+				}
+				b.writeValue(element)
+			}
+		}
+		b.WriteByte('}')
+	}
+}
@@ -0,0 +1,214 @@
+package exprel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// Array is a two-dimensional array of values, stored as a slice of rows. All
+// rows have the same number of columns. The elements of an Array may be of any
+// value type other than Array.
+//
+// Arrays are written in expressions as rows of values enclosed in braces (e.g.
+// ={1; 2 | 3; 4}), and are created and consumed by functions such as MAP and
+// INDEX.
+type Array [][]interface{}
+
+// Rows returns the number of rows of a.
+func (a Array) Rows() int {
+	return len(a)
+}
+
+// Columns returns the number of columns of a.
+func (a Array) Columns() int {
+	if len(a) == 0 {
+		return 0
+	}
+	return len(a[0])
+}
+
+// Record is a set of named values, such as a JSON object. The fields of a
+// record are accessed with dotted identifiers (e.g. customer.name), both when
+// the record is returned by a Source and when it is bound to a name by LET or
+// LAMBDA. The fields may be of any value type.
+type Record map[string]interface{}
+
+// Normalize converts value to one of the value types that an expression can
+// use (string, float64, bool, Func, Array, or Record). It is applied to every
+// value returned by a Source or a Func.
+//
+// The following conversions are performed:
+//  - integer and floating point types are converted to float64
+//  - types whose underlying type is string or bool are converted to string
+//    and bool, respectively
+//  - json.Number is converted to float64
+//  - time.Time is converted to a serial date number, as used by TEXT
+//  - function types whose underlying type is that of Func are converted to Func
+//  - *FuncDef is converted to a Func that calls FuncDef.Call
+//  - the elements of an Array are normalized
+//  - slices and arrays are converted to an Array with one column, unless all of
+//    their elements are slices or arrays, which are converted to the rows of
+//    an Array
+//  - maps whose keys are strings are converted to a Record, whose fields are
+//    normalized
+//  - non-nil pointers are dereferenced
+//
+// An error is returned if value cannot be converted.
+func Normalize(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string, float64, bool:
+		return v, nil
+	case Func:
+		if v == nil {
+			return nil, errors.New("nil function")
+		}
+		return v, nil
+	case *FuncDef:
+		if v == nil || v.Func == nil {
+			return nil, errors.New("nil function")
+		}
+		return Func(v.Call), nil
+	case nil:
+		return nil, errors.New("unsupported nil value")
+	case json.Number:
+		number, err := strconv.ParseFloat(string(v), 64)
+		if err != nil {
+			return nil, errors.New("invalid json.Number " + strconv.Quote(string(v)))
+		}
+		return number, nil
+	case time.Time:
+		return timeToSerial(v), nil
+	case Array:
+		return normalizeArray(v)
+	}
+	return normalizeValue(reflect.ValueOf(value))
+}
+
+// normalizeArray returns a copy of a whose elements are normalized. An error
+// is returned if the rows of a differ in length, or if an element is an Array.
+func normalizeArray(a Array) (Array, error) {
+	normalized := make(Array, len(a))
+	for i, row := range a {
+		if len(row) != a.Columns() {
+			return nil, errors.New("array rows differ in length")
+		}
+		normalized[i] = make([]interface{}, len(row))
+		for j, element := range row {
+			value, err := Normalize(element)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := value.(Array); ok {
+				return nil, errors.New("array contains an array")
+			}
+			normalized[i][j] = value
+		}
+	}
+	return normalized, nil
+}
+
+// normalizeList converts v, a slice or array, to an Array.
+func normalizeList(v reflect.Value) (interface{}, error) {
+	a := make(Array, v.Len())
+	rows := 0
+	for i := range a {
+		element := v.Index(i)
+		for (element.Kind() == reflect.Ptr || element.Kind() == reflect.Interface) && !element.IsNil() {
+			element = element.Elem()
+		}
+		if element.Kind() == reflect.Slice || element.Kind() == reflect.Array {
+			rows++
+			a[i] = make([]interface{}, element.Len())
+			for j := range a[i] {
+				a[i][j] = element.Index(j).Interface()
+			}
+		} else {
+			a[i] = []interface{}{element.Interface()}
+		}
+	}
+	if rows != 0 && rows != len(a) {
+		return nil, errors.New("array contains an array")
+	}
+	return normalizeArray(a)
+}
+
+// normalizeMap converts v, a map whose keys are strings, to a Record.
+func normalizeMap(v reflect.Value) (interface{}, error) {
+	record := make(Record, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		value, err := Normalize(iter.Value().Interface())
+		if err != nil {
+			return nil, err
+		}
+		record[iter.Key().String()] = value
+	}
+	return record, nil
+}
+
+func normalizeValue(v reflect.Value) (interface{}, error) {
+	t := v.Type()
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, errors.New("unsupported nil " + t.String())
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		return v.Bool(), nil
+	case reflect.String:
+		if v.Type() == reflect.TypeOf(json.Number("")) {
+			return Normalize(json.Number(v.String()))
+		}
+		return v.String(), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint()), nil
+	case reflect.Func:
+		if v.Type().ConvertibleTo(funcType) && !v.IsNil() {
+			return v.Convert(funcType).Interface().(Func), nil
+		}
+	case reflect.Slice, reflect.Array:
+		return normalizeList(v)
+	case reflect.Map:
+		if v.Type().Key().Kind() == reflect.String {
+			return normalizeMap(v)
+		}
+	case reflect.Struct:
+		if v.Type() == timeType {
+			return timeToSerial(v.Interface().(time.Time)), nil
+		}
+	}
+	return nil, errors.New("unsupported type " + t.String())
+}
+
+// StringerSource returns a Source that wraps s, converting values that
+// implement fmt.Stringer to strings, in preference to the conversions
+// performed by Normalize.
+func StringerSource(s Source) Source {
+	return stringerSource{s}
+}
+
+type stringerSource struct {
+	Source Source
+}
+
+func (s stringerSource) Get(ctx context.Context, name string) (interface{}, bool) {
+	value, ok := s.Source.Get(ctx, name)
+	if !ok {
+		return nil, false
+	}
+	if stringer, isStringer := value.(fmt.Stringer); isStringer {
+		return stringer.String(), true
+	}
+	return value, true
+}
@@ -0,0 +1,133 @@
+package exprel
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// VolatileFunc is a Func whose result may differ between calls with the same
+// arguments, such as RAND and NOW. It is converted to a Func by Normalize.
+//
+// Expressions that call a VolatileFunc are not deterministic (see
+// Expression.Deterministic).
+type VolatileFunc func(call *Call) (interface{}, error)
+
+// WithSeed returns a copy of ctx in which RAND, and other functions that use
+// Call.Random, draw numbers from a pseudo-random source seeded with seed.
+// Every evaluation with the returned context produces the same sequence of
+// numbers.
+func WithSeed(ctx context.Context, seed int64) context.Context {
+	return context.WithValue(ctx, seedKey, seed)
+}
+
+// WithClock returns a copy of ctx in which NOW, TODAY, and other functions that
+// use Call.Now, use the time returned by now instead of the system clock.
+func WithClock(ctx context.Context, now func() time.Time) context.Context {
+	return context.WithValue(ctx, clockKey, now)
+}
+
+// Random returns a pseudo-random number in [0, 1). If the context was created
+// by WithSeed, the number is drawn from the evaluation's seeded source;
+// otherwise, it is drawn from the default source of math/rand.
+func (c *Call) Random() float64 {
+	ctx := c.Context()
+	seed, ok := ctx.Value(seedKey).(int64)
+	if !ok {
+		return rand.Float64()
+	}
+	ev := evaluationFrom(ctx)
+	if ev == nil {
+		return rand.New(rand.NewSource(seed)).Float64()
+	}
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	if ev.rand == nil {
+		ev.rand = rand.New(rand.NewSource(seed))
+	}
+	return ev.rand.Float64()
+}
+
+// Now returns the current time, or the time of the clock given to WithClock.
+// All calls within an evaluation return the same time.
+func (c *Call) Now() time.Time {
+	ctx := c.Context()
+	now, ok := ctx.Value(clockKey).(func() time.Time)
+	if !ok {
+		now = time.Now
+	}
+	ev := evaluationFrom(ctx)
+	if ev == nil {
+		return now()
+	}
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	if ev.now.IsZero() {
+		ev.now = now()
+	}
+	return ev.now
+}
+
+// Deterministic reports whether e produces the same result every time it is
+// evaluated with s, assuming that the values of identifiers do not change. It
+// returns false if e references a VolatileFunc or volatile FuncDef of s (e.g.
+// RAND), whether it calls it or uses it as a value. The bodies of the Library
+// functions that e references are checked in the same way, with their names
+// resolved as they are during evaluation.
+//
+// The values of referenced names are looked up in s using the background
+// context.
+func (e *Expression) Deterministic(s Source) bool {
+	return deterministic(e.node, nil, s, make(map[*definition]bool))
+}
+
+// deterministic reports whether n references no volatile functions of s. The
+// names in params are bound by the enclosing function. visited contains the
+// Library functions that have already been checked.
+func deterministic(n node, params []string, s Source, visited map[*definition]bool) bool {
+	result := true
+	references(n, func(name string, call bool, span Span) {
+		if !result || containsName(params, name) {
+			return
+		}
+		value, ok := lookupValue(s, name)
+		if !ok {
+			return
+		}
+		if isVolatile(value) {
+			result = false
+			return
+		}
+		if def, ok := value.(*FuncDef); ok && def != nil && def.def != nil && !visited[def.def] {
+			visited[def.def] = true
+			result = deterministic(def.def.Body, def.def.Params, Sources{def.lib, s}, visited)
+		}
+	})
+	return result
+}
+
+// lookupValue looks up name in s using the background context. A name whose
+// lookup fails with a *RuntimeError (e.g. one denied by PolicySource) is
+// reported as not found.
+func lookupValue(s Source, name string) (value interface{}, ok bool) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			if _, isRuntimeErr := rec.(*RuntimeError); !isRuntimeErr {
+				panic(rec)
+			}
+			value, ok = nil, false
+		}
+	}()
+	return s.Get(context.Background(), name)
+}
+
+func isVolatile(value interface{}) bool {
+	switch v := value.(type) {
+	case VolatileFunc:
+		return true
+	case *FuncDef:
+		return v != nil && v.Volatile
+	default:
+		return false
+	}
+}
@@ -0,0 +1,154 @@
+package exprel
+
+import (
+	"strings"
+)
+
+// children returns the direct child nodes of n.
+func children(n node) []node {
+	switch n := n.(type) {
+	case *arrayNode:
+		var list []node
+		for _, row := range n.Rows {
+			list = append(list, row...)
+		}
+		return list
+	case *notNode:
+		return []node{n.Operand}
+	case *callNode:
+		return n.Args
+	case *concatNode:
+		return []node{n.LHS, n.RHS}
+	case *mathNode:
+		return []node{n.LHS, n.RHS}
+	case *eqNode:
+		return []node{n.LHS, n.RHS}
+	case *cmpNode:
+		return []node{n.LHS, n.RHS}
+	case *andNode:
+		return n.Operands
+	case *orNode:
+		return n.Operands
+	case *ifNode:
+		return []node{n.Cond, n.True, n.False}
+	case *ifsNode:
+		return n.Operands
+	case *switchNode:
+		list := []node{n.Value}
+		for i := range n.Cases {
+			list = append(list, n.Cases[i], n.Results[i])
+		}
+		if n.Default != nil {
+			list = append(list, n.Default)
+		}
+		return list
+	case *xorNode:
+		return n.Operands
+	case *letNode:
+		return append(append([]node(nil), n.Values...), n.Body)
+	case *lambdaNode:
+		return []node{n.Body}
+	case *invokeNode:
+		return append([]node{n.Fn}, n.Args...)
+	default:
+		return nil
+	}
+}
+
+// references calls fn for each identifier and function name referenced by n
+// that is not bound by an enclosing LET or LAMBDA. call is true if the name
+// is referenced in a function call, and span is the location of the
+// reference.
+//
+// An identifier that is invoked (e.g. =(RAND)()) is reported as a call. So is
+// an identifier that is bound by LET to a name that is called or invoked (e.g.
+// RAND in =LET(f; RAND; f())); it is reported once where it is bound, and
+// again, with the same span, for each call.
+func references(n node, fn func(name string, call bool, span Span)) {
+	// bindings of the enclosing LET and LAMBDA expressions. alias is the
+	// unbound identifier that a name is bound to by LET, if any.
+	type binding struct {
+		name  string
+		alias *lookupNode
+	}
+	var scope []binding
+	// lookup returns the binding of name, or of the record whose field name
+	// refers to (e.g. order in order.total)
+	lookup := func(name string) (binding, bool) {
+		for i := len(scope) - 1; i >= 0; i-- {
+			if scope[i].name == name {
+				return scope[i], true
+			}
+			if strings.HasPrefix(name, scope[i].name) && name[len(scope[i].name)] == '.' {
+				return binding{name: scope[i].name}, true
+			}
+		}
+		return binding{}, false
+	}
+	// called reports a call of name at span
+	called := func(name string, span Span) {
+		b, bound := lookup(name)
+		switch {
+		case !bound:
+			fn(name, true, span)
+		case b.alias != nil:
+			fn(b.alias.Name, true, b.alias.Span)
+		}
+	}
+	var visit func(n node)
+	visit = func(n node) {
+		switch n := n.(type) {
+		case *lookupNode:
+			if _, bound := lookup(n.Name); !bound {
+				fn(n.Name, false, n.Span)
+			}
+		case *callNode:
+			called(n.Name, n.Span)
+		case *invokeNode:
+			if l, ok := n.Fn.(*lookupNode); ok {
+				called(l.Name, l.Span)
+				for _, arg := range n.Args {
+					visit(arg)
+				}
+				return
+			}
+		case *letNode:
+			mark := len(scope)
+			for i, name := range n.Names {
+				visit(n.Values[i])
+				b := binding{name: name}
+				if l, ok := n.Values[i].(*lookupNode); ok {
+					if outer, bound := lookup(l.Name); !bound {
+						b.alias = l
+					} else {
+						b.alias = outer.alias
+					}
+				}
+				scope = append(scope, b)
+			}
+			visit(n.Body)
+			scope = scope[:mark]
+			return
+		case *lambdaNode:
+			mark := len(scope)
+			for _, name := range n.Params {
+				scope = append(scope, binding{name: name})
+			}
+			visit(n.Body)
+			scope = scope[:mark]
+			return
+		}
+		for _, child := range children(n) {
+			visit(child)
+		}
+	}
+	visit(n)
+}
+
+// walkNodes calls fn for n and each of its descendants.
+func walkNodes(n node, fn func(node)) {
+	fn(n)
+	for _, child := range children(n) {
+		walkNodes(child, fn)
+	}
+}
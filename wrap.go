@@ -0,0 +1,245 @@
+package exprel
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"strconv"
+)
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	callType    = reflect.TypeOf((*Call)(nil))
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+	funcType    = reflect.TypeOf((Func)(nil))
+	arrayType   = reflect.TypeOf(Array(nil))
+	recordType  = reflect.TypeOf(Record(nil))
+	anyType     = reflect.TypeOf((*interface{})(nil)).Elem()
+)
+
+// WrapFunc returns a Func that calls fn, which must be a function. Arguments
+// from the expression are validated and converted to the types of fn's
+// parameters, and fn's return value is converted to an expression value.
+//
+// fn may accept, in order:
+//  - an optional context.Context, which receives Call.Context()
+//  - an optional *Call, which receives the current call
+//  - any number of required parameters
+//  - any number of optional parameters, of pointer type, which are nil if the
+//    argument was not given
+//  - a variadic parameter
+// Parameters of type string, bool, interface{}, Func, Array, Record, and any
+// integer or floating point type are supported. Numbers converted to integers
+// must be integral and within the range of the integer type.
+//
+// fn must return a single value, optionally followed by an error. The value
+// is converted as described by Normalize.
+//
+// WrapFunc panics if fn does not satisfy the above requirements.
+func WrapFunc(fn interface{}) Func {
+	v := reflect.ValueOf(fn)
+	t := v.Type()
+	if t.Kind() != reflect.Func {
+		panic("exprel: WrapFunc expects function, got " + t.String())
+	}
+	w, err := newWrapper(t)
+	if err != "" {
+		panic("exprel: WrapFunc: " + err)
+	}
+	return func(c *Call) (interface{}, error) {
+		return w.call(v, c)
+	}
+}
+
+// wrapper is a precomputed plan for calling a function via reflection.
+type wrapper struct {
+	hasContext bool
+	hasCall    bool
+	required   []argConverter
+	optional   []argConverter
+	variadic   *argConverter
+	hasError   bool
+}
+
+type argConverter struct {
+	Type     reflect.Type
+	TypeName string
+	Convert  func(value interface{}) (reflect.Value, bool)
+}
+
+// newWrapper creates a wrapper for function type t. On failure, a description
+// of the problem is returned.
+func newWrapper(t reflect.Type) (*wrapper, string) {
+	w := &wrapper{}
+	i := 0
+	if i < t.NumIn() && t.In(i) == contextType {
+		w.hasContext = true
+		i++
+	}
+	if i < t.NumIn() && t.In(i) == callType {
+		w.hasCall = true
+		i++
+	}
+	for ; i < t.NumIn(); i++ {
+		in := t.In(i)
+		if t.IsVariadic() && i == t.NumIn()-1 {
+			conv, ok := newArgConverter(in.Elem())
+			if !ok {
+				return nil, "unsupported variadic parameter type " + in.Elem().String()
+			}
+			w.variadic = &conv
+			break
+		}
+		if in.Kind() == reflect.Ptr {
+			conv, ok := newArgConverter(in.Elem())
+			if !ok {
+				return nil, "unsupported parameter type " + in.String()
+			}
+			elem := conv.Convert
+			conv.Type = in
+			conv.Convert = func(value interface{}) (reflect.Value, bool) {
+				v, ok := elem(value)
+				if !ok {
+					return v, false
+				}
+				ptr := reflect.New(v.Type())
+				ptr.Elem().Set(v)
+				return ptr, true
+			}
+			w.optional = append(w.optional, conv)
+			continue
+		}
+		if len(w.optional) > 0 {
+			return nil, "required parameter follows optional parameter"
+		}
+		conv, ok := newArgConverter(in)
+		if !ok {
+			return nil, "unsupported parameter type " + in.String()
+		}
+		w.required = append(w.required, conv)
+	}
+
+	switch t.NumOut() {
+	case 2:
+		if t.Out(1) != errorType {
+			return nil, "second return value must be error"
+		}
+		w.hasError = true
+	case 1:
+	default:
+		return nil, "function must return one value, optionally followed by an error"
+	}
+	return w, ""
+}
+
+func newArgConverter(t reflect.Type) (argConverter, bool) {
+	switch {
+	case t == anyType:
+		return argConverter{t, "value", func(value interface{}) (reflect.Value, bool) {
+			return reflect.ValueOf(&value).Elem(), true
+		}}, true
+	case t == funcType:
+		return argConverter{t, "function", func(value interface{}) (reflect.Value, bool) {
+			fn, ok := value.(Func)
+			return reflect.ValueOf(fn), ok
+		}}, true
+	case t == arrayType:
+		return argConverter{t, "array", func(value interface{}) (reflect.Value, bool) {
+			a, ok := value.(Array)
+			return reflect.ValueOf(a), ok
+		}}, true
+	case t == recordType:
+		return argConverter{t, "record", func(value interface{}) (reflect.Value, bool) {
+			record, ok := value.(Record)
+			return reflect.ValueOf(record), ok
+		}}, true
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return argConverter{t, "string", func(value interface{}) (reflect.Value, bool) {
+			str, ok := value.(string)
+			return reflect.ValueOf(str).Convert(t), ok
+		}}, true
+	case reflect.Bool:
+		return argConverter{t, "bool", func(value interface{}) (reflect.Value, bool) {
+			b, ok := value.(bool)
+			return reflect.ValueOf(b).Convert(t), ok
+		}}, true
+	case reflect.Float32, reflect.Float64:
+		return argConverter{t, "number", func(value interface{}) (reflect.Value, bool) {
+			number, ok := value.(float64)
+			return reflect.ValueOf(number).Convert(t), ok
+		}}, true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return argConverter{t, "integer", func(value interface{}) (reflect.Value, bool) {
+			v := reflect.New(t).Elem()
+			number, ok := value.(float64)
+			if !ok || number != math.Trunc(number) || !(number >= -1<<63 && number < 1<<63) || v.OverflowInt(int64(number)) {
+				return v, false
+			}
+			v.SetInt(int64(number))
+			return v, true
+		}}, true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return argConverter{t, "non-negative integer", func(value interface{}) (reflect.Value, bool) {
+			v := reflect.New(t).Elem()
+			number, ok := value.(float64)
+			if !ok || number != math.Trunc(number) || !(number >= 0 && number < 1<<64) || v.OverflowUint(uint64(number)) {
+				return v, false
+			}
+			v.SetUint(uint64(number))
+			return v, true
+		}}, true
+	}
+	return argConverter{}, false
+}
+
+// call invokes fn with the arguments of c.
+func (w *wrapper) call(fn reflect.Value, c *Call) (interface{}, error) {
+	min := len(w.required)
+	max := min + len(w.optional)
+	if len(c.Values) < min || (w.variadic == nil && len(c.Values) > max) {
+		switch {
+		case w.variadic != nil:
+			panic(&RuntimeError{Message: c.Name + " expects at least " + strconv.Itoa(min) + " arguments", Kind: ErrArgumentCount})
+		case min == max:
+			panic(&RuntimeError{Message: c.Name + " expects " + strconv.Itoa(min) + " arguments", Kind: ErrArgumentCount})
+		default:
+			panic(&RuntimeError{Message: c.Name + " expects " + strconv.Itoa(min) + " to " + strconv.Itoa(max) + " arguments", Kind: ErrArgumentCount})
+		}
+	}
+
+	in := make([]reflect.Value, 0, 2+len(c.Values)+len(w.optional))
+	if w.hasContext {
+		ctx := c.Context()
+		in = append(in, reflect.ValueOf(&ctx).Elem())
+	}
+	if w.hasCall {
+		in = append(in, reflect.ValueOf(c))
+	}
+	for i, value := range c.Values {
+		var conv *argConverter
+		switch {
+		case i < min:
+			conv = &w.required[i]
+		case i < max:
+			conv = &w.optional[i-min]
+		default:
+			conv = w.variadic
+		}
+		v, ok := conv.Convert(value)
+		if !ok {
+			panic(&RuntimeError{Message: c.Name + " expects argument " + strconv.Itoa(i) + " to be " + conv.TypeName, Kind: ErrTypeMismatch})
+		}
+		in = append(in, v)
+	}
+	for i := len(c.Values); i < max; i++ {
+		in = append(in, reflect.Zero(w.optional[i-min].Type))
+	}
+
+	out := fn.Call(in)
+	if w.hasError && !out[1].IsNil() {
+		return nil, out[1].Interface().(error)
+	}
+	return out[0].Interface(), nil
+}